@@ -0,0 +1,119 @@
+package css
+
+import (
+	"golang.org/x/net/html"
+)
+
+// bloomFilter is a bloom filter of the tags, ids and classes of the ancestors of a node.
+// Like in browsers, it allows rejecting descendant and child selectors without walking up the tree:
+// if any tag, id or class required of an ancestor is missing from the filter, the selector cannot match.
+type bloomFilter [8]uint64
+
+func (f *bloomFilter) add(h uint32) {
+	f[h>>6&7] |= 1 << (h & 63)
+	f[h>>22&7] |= 1 << (h >> 16 & 63)
+}
+
+func (f *bloomFilter) has(h uint32) bool {
+	return f[h>>6&7]&(1<<(h&63)) != 0 && f[h>>22&7]&(1<<(h>>16&63)) != 0
+}
+
+func (f *bloomFilter) hasAll(hs *hashes) bool {
+	for _, h := range hs.hs[:hs.n] {
+		if !f.has(h) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) addNode(n *html.Node) {
+	f.add(hash('<', n.Data))
+	idAdded, classAdded := false, false
+	for _, a := range n.Attr {
+		if a.Key == "id" && !idAdded {
+			f.add(hash('#', a.Val))
+			idAdded = true
+		} else if a.Key == "class" && !classAdded {
+			for i, j := 0, 0; j <= len(a.Val); j++ {
+				if j == len(a.Val) || isWhitespace(rune(a.Val[j])) {
+					if i < j {
+						f.add(hash('.', a.Val[i:j]))
+					}
+					i = j + 1
+				}
+			}
+			classAdded = true
+		}
+	}
+}
+
+// ancestorFilter returns the bloom filter of all ancestors of n.
+func ancestorFilter(n *html.Node) (f bloomFilter) {
+	for n := n.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode {
+			f.addNode(n)
+		}
+	}
+	return f
+}
+
+// hashes is a bounded list of hashes. Hashes beyond its capacity are dropped -
+// that only makes the bloom filter less selective, never wrong.
+type hashes struct {
+	n  int
+	hs [16]uint32
+}
+
+func (hs *hashes) add(h uint32) {
+	if hs.n < len(hs.hs) {
+		hs.hs[hs.n], hs.n = h, hs.n+1
+	}
+}
+
+// ancestorHashes adds the hashes of the tags, ids and classes that must be present
+// among the ancestors of any node matched by s.
+func ancestorHashes(s Selector, hs *hashes) {
+	switch s := s.(type) {
+	case *DescendantSelector:
+		compoundHashes(subject(s.Ancestor), hs)
+		ancestorHashes(s.Ancestor, hs)
+		ancestorHashes(s.Selector, hs)
+	case *ChildSelector:
+		compoundHashes(subject(s.Parent), hs)
+		ancestorHashes(s.Parent, hs)
+		ancestorHashes(s.Selector, hs)
+	case *NextSiblingSelector:
+		ancestorHashes(s.Sibling, hs)
+		ancestorHashes(s.Selector, hs)
+	case *SubsequentSiblingSelector:
+		ancestorHashes(s.Sibling, hs)
+		ancestorHashes(s.Selector, hs)
+	}
+}
+
+func compoundHashes(s Selector, hs *hashes) {
+	sequence, ok := s.(*SelectorSequence)
+	if !ok {
+		return
+	}
+	for _, s := range sequence.Selectors {
+		switch s := s.(type) {
+		case *ElementSelector:
+			hs.add(hash('<', s.Element))
+		case *IDSelector:
+			hs.add(hash('#', s.Value))
+		case *ClassSelector:
+			hs.add(hash('.', s.Value))
+		}
+	}
+}
+
+// hash is the 32 bit FNV-1a hash of prefix followed by s.
+func hash(prefix byte, s string) uint32 {
+	h := (2166136261 ^ uint32(prefix)) * 16777619
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint32(s[i])) * 16777619
+	}
+	return h
+}
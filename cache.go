@@ -0,0 +1,115 @@
+package css
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache is a bounded, concurrency-safe LRU cache of compiled selectors (and compilation errors).
+// Entries are keyed by the exact selector string and recompiled when entries are added to or removed from
+// PseudoClasses, PseudoClassExtensions, PseudoFunctions, PseudoFunctionExtensions, Matchers or Combinators.
+// Call RegistryChanged (or Purge) after replacing an entry.
+type Cache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type CacheStats struct {
+	Hits, Misses int
+}
+
+type cacheEntry struct {
+	selector string
+	version  registryVersion
+	compiled Selector
+	err      error
+}
+
+func NewCache(size int) *Cache {
+	if size < 1 {
+		panic("invalid cache size")
+	}
+	return &Cache{size: size, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *Cache) Compile(selector string) (Selector, error) {
+	c.mutex.Lock()
+	if e, ok := c.entries[selector]; ok && e.Value.(*cacheEntry).current() {
+		c.stats.Hits++
+		c.lru.MoveToFront(e)
+		entry := e.Value.(*cacheEntry)
+		c.mutex.Unlock()
+		return entry.compiled, entry.err
+	}
+	c.stats.Misses++
+	c.mutex.Unlock()
+	version := currentRegistryVersion()
+	s, err := Compile(selector)
+	entry := &cacheEntry{selector: selector, version: version, compiled: s, err: err}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[selector]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[selector] = c.lru.PushFront(entry)
+		if c.lru.Len() > c.size {
+			delete(c.entries, c.lru.Remove(c.lru.Back()).(*cacheEntry).selector)
+		}
+	}
+	return s, err
+}
+
+func (c *Cache) MustCompile(selector string) Selector {
+	s, err := c.Compile(selector)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// Purge removes all entries from the cache. Stats are kept.
+func (c *Cache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries, c.lru = map[string]*list.Element{}, list.New()
+}
+
+// current reports whether the registries are unchanged since the entry was compiled.
+func (e *cacheEntry) current() bool { return currentRegistryVersion() == e.version }
+
+// registryVersion identifies the state of the registries. Added and removed entries change the sizes, replaced
+// entries (and registries) have to be announced with RegistryChanged.
+type registryVersion struct {
+	generation uint64
+	sizes      [6]int
+}
+
+var registryGeneration uint64
+
+// RegistryChanged must be called after replacing entries of PseudoClasses, PseudoClassExtensions, PseudoFunctions,
+// PseudoFunctionExtensions, Matchers or Combinators (or the registries themselves). It invalidates the selectors
+// compiled by all caches and the tokens known to the lexer. Adding or removing entries is picked up without it - unless an entry is removed and
+// another one added in its place.
+func RegistryChanged() { atomic.AddUint64(&registryGeneration, 1) }
+
+func currentRegistryVersion() registryVersion {
+	return registryVersion{atomic.LoadUint64(&registryGeneration), [6]int{len(PseudoClasses), len(PseudoClassExtensions),
+		len(PseudoFunctions), len(PseudoFunctionExtensions), len(Matchers), len(Combinators)}}
+}
@@ -0,0 +1,15 @@
+// Package example contains selectors compiled by cssgen - see selectors_css.go.
+package example
+
+//go:generate go run .. -file=$GOFILE -testdata=../../../testdata/*.html
+
+//css:Items ul li
+//css:Pears ul *.pear
+//css:Fruits .pear, .apple
+//css:ArticleSpans .article > .body > p > span
+//css:NestedMatched div div.matched
+//css:Siblings li + li ~ li
+//css:Languages [lang|="en"]
+//css:Attributes p[id^=f], p[id*=o], p[id$="oo"], p[class~=a], p[class^=""]
+//css:Odd li:nth-child(odd)
+//css:NotFoo .ids :not(#foo)
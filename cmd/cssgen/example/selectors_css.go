@@ -0,0 +1,403 @@
+// Code generated by cssgen. DO NOT EDIT.
+
+package example
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/niklasfasching/css"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+type itemsSelector struct{}
+
+func (itemsSelector) Match(n *html.Node) bool { return matchItems_2(n) }
+func (itemsSelector) String() string          { return "ul li" }
+
+var Items css.Selector = itemsSelector{}
+
+type pearsSelector struct{}
+
+func (pearsSelector) Match(n *html.Node) bool { return matchPears_2(n) }
+func (pearsSelector) String() string          { return "ul *.pear" }
+
+var Pears css.Selector = pearsSelector{}
+
+type fruitsSelector struct{}
+
+func (fruitsSelector) Match(n *html.Node) bool { return matchFruits_2(n) }
+func (fruitsSelector) String() string          { return ".pear, .apple" }
+
+var Fruits css.Selector = fruitsSelector{}
+
+type articleSpansSelector struct{}
+
+func (articleSpansSelector) Match(n *html.Node) bool { return matchArticleSpans_6(n) }
+func (articleSpansSelector) String() string          { return ".article > .body > p > span" }
+
+var ArticleSpans css.Selector = articleSpansSelector{}
+
+type nestedMatchedSelector struct{}
+
+func (nestedMatchedSelector) Match(n *html.Node) bool { return matchNestedMatched_2(n) }
+func (nestedMatchedSelector) String() string          { return "div div.matched" }
+
+var NestedMatched css.Selector = nestedMatchedSelector{}
+
+type siblingsSelector struct{}
+
+func (siblingsSelector) Match(n *html.Node) bool { return matchSiblings_4(n) }
+func (siblingsSelector) String() string          { return "li + li ~ li" }
+
+var Siblings css.Selector = siblingsSelector{}
+
+type languagesSelector struct{}
+
+func (languagesSelector) Match(n *html.Node) bool { return matchLanguages_0(n) }
+func (languagesSelector) String() string          { return "[lang|=\"en\"]" }
+
+var Languages css.Selector = languagesSelector{}
+
+type attributesSelector struct{}
+
+func (attributesSelector) Match(n *html.Node) bool { return matchAttributes_8(n) }
+func (attributesSelector) String() string {
+	return "p[id^=\"f\"], p[id*=\"o\"], p[id$=\"oo\"], p[class~=\"a\"], p[class^=\"\"]"
+}
+
+var Attributes css.Selector = attributesSelector{}
+
+type oddSelector struct{}
+
+func (oddSelector) Match(n *html.Node) bool { return matchOdd_0(n) }
+func (oddSelector) String() string          { return "li:nth-child(odd)" }
+
+var Odd css.Selector = oddSelector{}
+
+type notFooSelector struct{}
+
+func (notFooSelector) Match(n *html.Node) bool { return matchNotFoo_2(n) }
+func (notFooSelector) String() string          { return ".ids :not(#foo)" }
+
+var NotFoo css.Selector = notFooSelector{}
+
+func matchItems_0(n *html.Node) bool {
+	if n.DataAtom != atom.Ul && (n.DataAtom != 0 || n.Data != "ul") {
+		return false
+	}
+	return true
+}
+
+func matchItems_1(n *html.Node) bool {
+	if n.DataAtom != atom.Li && (n.DataAtom != 0 || n.Data != "li") {
+		return false
+	}
+	return true
+}
+
+func matchItems_2(n *html.Node) bool {
+	if !matchItems_1(n) {
+		return false
+	}
+	for n := n.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && matchItems_0(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPears_0(n *html.Node) bool {
+	if n.DataAtom != atom.Ul && (n.DataAtom != 0 || n.Data != "ul") {
+		return false
+	}
+	return true
+}
+
+func matchPears_1(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "pear") {
+		return false
+	}
+	return true
+}
+
+func matchPears_2(n *html.Node) bool {
+	if !matchPears_1(n) {
+		return false
+	}
+	for n := n.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && matchPears_0(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFruits_0(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "pear") {
+		return false
+	}
+	return true
+}
+
+func matchFruits_1(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "apple") {
+		return false
+	}
+	return true
+}
+
+func matchFruits_2(n *html.Node) bool {
+	return matchFruits_0(n) || matchFruits_1(n)
+}
+
+func matchArticleSpans_0(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "article") {
+		return false
+	}
+	return true
+}
+
+func matchArticleSpans_1(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "body") {
+		return false
+	}
+	return true
+}
+
+func matchArticleSpans_2(n *html.Node) bool {
+	p := n.Parent
+	return matchArticleSpans_1(n) && p != nil && p.Type == html.ElementNode && matchArticleSpans_0(p)
+}
+
+func matchArticleSpans_3(n *html.Node) bool {
+	if n.DataAtom != atom.P && (n.DataAtom != 0 || n.Data != "p") {
+		return false
+	}
+	return true
+}
+
+func matchArticleSpans_4(n *html.Node) bool {
+	p := n.Parent
+	return matchArticleSpans_3(n) && p != nil && p.Type == html.ElementNode && matchArticleSpans_2(p)
+}
+
+func matchArticleSpans_5(n *html.Node) bool {
+	if n.DataAtom != atom.Span && (n.DataAtom != 0 || n.Data != "span") {
+		return false
+	}
+	return true
+}
+
+func matchArticleSpans_6(n *html.Node) bool {
+	p := n.Parent
+	return matchArticleSpans_5(n) && p != nil && p.Type == html.ElementNode && matchArticleSpans_4(p)
+}
+
+func matchNestedMatched_0(n *html.Node) bool {
+	if n.DataAtom != atom.Div && (n.DataAtom != 0 || n.Data != "div") {
+		return false
+	}
+	return true
+}
+
+func matchNestedMatched_1(n *html.Node) bool {
+	if n.DataAtom != atom.Div && (n.DataAtom != 0 || n.Data != "div") {
+		return false
+	}
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "matched") {
+		return false
+	}
+	return true
+}
+
+func matchNestedMatched_2(n *html.Node) bool {
+	if !matchNestedMatched_1(n) {
+		return false
+	}
+	for n := n.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && matchNestedMatched_0(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSiblings_0(n *html.Node) bool {
+	if n.DataAtom != atom.Li && (n.DataAtom != 0 || n.Data != "li") {
+		return false
+	}
+	return true
+}
+
+func matchSiblings_1(n *html.Node) bool {
+	if n.DataAtom != atom.Li && (n.DataAtom != 0 || n.Data != "li") {
+		return false
+	}
+	return true
+}
+
+func matchSiblings_2(n *html.Node) bool {
+	p := n.PrevSibling
+	return matchSiblings_1(n) && p != nil && p.Type == html.ElementNode && matchSiblings_0(p)
+}
+
+func matchSiblings_3(n *html.Node) bool {
+	if n.DataAtom != atom.Li && (n.DataAtom != 0 || n.Data != "li") {
+		return false
+	}
+	return true
+}
+
+func matchSiblings_4(n *html.Node) bool {
+	if !matchSiblings_3(n) {
+		return false
+	}
+	for n := n.PrevSibling; n != nil; n = n.PrevSibling {
+		if n.Type == html.ElementNode && matchSiblings_2(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchLanguages_0(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "lang"); !ok || v != "en" && !strings.HasPrefix(v, "en-") {
+		return false
+	}
+	return true
+}
+
+func matchAttributes_0(n *html.Node) bool {
+	if n.DataAtom != atom.P && (n.DataAtom != 0 || n.Data != "p") {
+		return false
+	}
+	if v, ok := cssgenAttribute(n, "id"); !ok || !strings.HasPrefix(v, "f") {
+		return false
+	}
+	return true
+}
+
+func matchAttributes_1(n *html.Node) bool {
+	if n.DataAtom != atom.P && (n.DataAtom != 0 || n.Data != "p") {
+		return false
+	}
+	if v, ok := cssgenAttribute(n, "id"); !ok || !strings.Contains(v, "o") {
+		return false
+	}
+	return true
+}
+
+func matchAttributes_2(n *html.Node) bool {
+	return matchAttributes_0(n) || matchAttributes_1(n)
+}
+
+func matchAttributes_3(n *html.Node) bool {
+	if n.DataAtom != atom.P && (n.DataAtom != 0 || n.Data != "p") {
+		return false
+	}
+	if v, ok := cssgenAttribute(n, "id"); !ok || !strings.HasSuffix(v, "oo") {
+		return false
+	}
+	return true
+}
+
+func matchAttributes_4(n *html.Node) bool {
+	return matchAttributes_2(n) || matchAttributes_3(n)
+}
+
+func matchAttributes_5(n *html.Node) bool {
+	if n.DataAtom != atom.P && (n.DataAtom != 0 || n.Data != "p") {
+		return false
+	}
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "a") {
+		return false
+	}
+	return true
+}
+
+func matchAttributes_6(n *html.Node) bool {
+	return matchAttributes_4(n) || matchAttributes_5(n)
+}
+
+func matchAttributes_7(n *html.Node) bool {
+	return false
+}
+
+func matchAttributes_8(n *html.Node) bool {
+	return matchAttributes_6(n) || matchAttributes_7(n)
+}
+
+func matchOdd_0(n *html.Node) bool {
+	if n.DataAtom != atom.Li && (n.DataAtom != 0 || n.Data != "li") {
+		return false
+	}
+	if !cssgenFallback0.Match(n) {
+		return false
+	}
+	return true
+}
+
+func matchNotFoo_0(n *html.Node) bool {
+	if v, ok := cssgenAttribute(n, "class"); !ok || !cssgenIncludes(v, "ids") {
+		return false
+	}
+	return true
+}
+
+func matchNotFoo_1(n *html.Node) bool {
+	if !cssgenFallback1.Match(n) {
+		return false
+	}
+	return true
+}
+
+func matchNotFoo_2(n *html.Node) bool {
+	if !matchNotFoo_1(n) {
+		return false
+	}
+	for n := n.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && matchNotFoo_0(n) {
+			return true
+		}
+	}
+	return false
+}
+
+var cssgenFallback0 = &cssgenFallback{selector: ":nth-child(odd)"}
+
+var cssgenFallback1 = &cssgenFallback{selector: ":not(#foo)"}
+
+func cssgenAttribute(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func cssgenIncludes(value, sValue string) bool {
+	for {
+		if i := strings.IndexAny(value, " \t\r\n\f"); i == -1 {
+			return value == sValue
+		} else if value[:i] == sValue {
+			return true
+		} else {
+			value = value[i+1:]
+		}
+	}
+}
+
+type cssgenFallback struct {
+	once     sync.Once
+	selector string
+	compiled css.Selector
+}
+
+func (f *cssgenFallback) Match(n *html.Node) bool {
+	f.once.Do(func() { f.compiled = css.MustCompile(f.selector) })
+	return f.compiled.Match(n)
+}
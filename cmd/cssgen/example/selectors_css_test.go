@@ -0,0 +1,52 @@
+// Code generated by cssgen. DO NOT EDIT.
+
+package example
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/niklasfasching/css"
+	"golang.org/x/net/html"
+)
+
+func TestCSSGenSelectorsCss(t *testing.T) {
+	paths, err := filepath.Glob("../../../testdata/*.html")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no test data: %v", err)
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := html.Parse(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []struct {
+			name      string
+			generated css.Selector
+			selector  string
+		}{
+			{"Items", Items, "ul li"},
+			{"Pears", Pears, "ul *.pear"},
+			{"Fruits", Fruits, ".pear, .apple"},
+			{"ArticleSpans", ArticleSpans, ".article > .body > p > span"},
+			{"NestedMatched", NestedMatched, "div div.matched"},
+			{"Siblings", Siblings, "li + li ~ li"},
+			{"Languages", Languages, "[lang|=\"en\"]"},
+			{"Attributes", Attributes, "p[id^=f], p[id*=o], p[id$=\"oo\"], p[class~=a], p[class^=\"\"]"},
+			{"Odd", Odd, "li:nth-child(odd)"},
+			{"NotFoo", NotFoo, ".ids :not(#foo)"},
+		} {
+			expected, actual := css.All(css.MustCompile(s.selector), document), css.All(s.generated, document)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: %s: %s: got %d nodes, expected %d", path, s.name, s.selector, len(actual), len(expected))
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+
+	"github.com/niklasfasching/css"
+	"golang.org/x/net/html/atom"
+)
+
+// generator emits one match function per selector node. Nodes that cannot be specialized
+// (pseudo-classes, custom matchers, combinators and selectors) fall back to the interpreted css.Selector.
+type generator struct {
+	functions bytes.Buffer
+	fallbacks []string
+	helpers   map[string]bool
+	imports   map[string]bool
+	name      string
+	count     int
+}
+
+var helpers = map[string]string{
+	"attribute": `func cssgenAttribute(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}`,
+	"includes": `func cssgenIncludes(value, sValue string) bool {
+	for {
+		if i := strings.IndexAny(value, " \t\r\n\f"); i == -1 {
+			return value == sValue
+		} else if value[:i] == sValue {
+			return true
+		} else {
+			value = value[i+1:]
+		}
+	}
+}`,
+	"fallback": `type cssgenFallback struct {
+	once     sync.Once
+	selector string
+	compiled css.Selector
+}
+
+func (f *cssgenFallback) Match(n *html.Node) bool {
+	f.once.Do(func() { f.compiled = css.MustCompile(f.selector) })
+	return f.compiled.Match(n)
+}`,
+}
+
+func generate(pkg string, directives []directive) []byte {
+	g := &generator{
+		helpers: map[string]bool{},
+		imports: map[string]bool{"github.com/niklasfasching/css": true, "golang.org/x/net/html": true},
+	}
+	declarations := &bytes.Buffer{}
+	for _, d := range directives {
+		g.name, g.count = d.name, 0
+		f, t := g.selector(d.compiled), unexport(d.name)+"Selector"
+		fmt.Fprintf(declarations, "type %s struct{}\n\n", t)
+		fmt.Fprintf(declarations, "func (%s) Match(n *html.Node) bool { return %s(n) }\n", t, f)
+		fmt.Fprintf(declarations, "func (%s) String() string { return %q }\n\n", t, d.compiled.String())
+		fmt.Fprintf(declarations, "var %s css.Selector = %s{}\n\n", d.name, t)
+	}
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "// Code generated by cssgen. DO NOT EDIT.\n\npackage %s\n\nimport (\n", pkg)
+	for _, i := range []string{"strings", "sync", "", "github.com/niklasfasching/css", "golang.org/x/net/html", "golang.org/x/net/html/atom"} {
+		if i == "" {
+			fmt.Fprintln(w)
+		} else if g.imports[i] {
+			fmt.Fprintf(w, "%q\n", i)
+		}
+	}
+	fmt.Fprintf(w, ")\n\n")
+	w.Write(declarations.Bytes())
+	w.Write(g.functions.Bytes())
+	for i, selector := range g.fallbacks {
+		fmt.Fprintf(w, "var cssgenFallback%d = &cssgenFallback{selector: %q}\n\n", i, selector)
+	}
+	for _, helper := range []string{"attribute", "includes", "fallback"} {
+		if g.helpers[helper] {
+			fmt.Fprintf(w, "%s\n\n", helpers[helper])
+		}
+	}
+	return w.Bytes()
+}
+
+// selector generates the match function for s and returns its name.
+func (g *generator) selector(s css.Selector) string {
+	switch s := s.(type) {
+	case *css.SelectorSequence:
+		body := ""
+		for _, s := range s.Selectors {
+			condition, ok := g.simpleSelector(s)
+			if !ok {
+				return g.function("return false")
+			} else if condition != "" {
+				body += fmt.Sprintf("if %s {\nreturn false\n}\n", condition)
+			}
+		}
+		return g.function(body + "return true")
+	case *css.UnionSelector:
+		a, b := g.selector(s.SelectorA), g.selector(s.SelectorB)
+		return g.function(fmt.Sprintf("return %s(n) || %s(n)", a, b))
+	case *css.DescendantSelector:
+		ancestor, selector := g.selector(s.Ancestor), g.selector(s.Selector)
+		return g.function(fmt.Sprintf(`if !%s(n) {
+			return false
+		}
+		for n := n.Parent; n != nil; n = n.Parent {
+			if n.Type == html.ElementNode && %s(n) {
+				return true
+			}
+		}
+		return false`, selector, ancestor))
+	case *css.ChildSelector:
+		parent, selector := g.selector(s.Parent), g.selector(s.Selector)
+		return g.function(fmt.Sprintf("p := n.Parent\nreturn %s(n) && p != nil && p.Type == html.ElementNode && %s(p)", selector, parent))
+	case *css.NextSiblingSelector:
+		sibling, selector := g.selector(s.Sibling), g.selector(s.Selector)
+		return g.function(fmt.Sprintf("p := n.PrevSibling\nreturn %s(n) && p != nil && p.Type == html.ElementNode && %s(p)", selector, sibling))
+	case *css.SubsequentSiblingSelector:
+		sibling, selector := g.selector(s.Sibling), g.selector(s.Selector)
+		return g.function(fmt.Sprintf(`if !%s(n) {
+			return false
+		}
+		for n := n.PrevSibling; n != nil; n = n.PrevSibling {
+			if n.Type == html.ElementNode && %s(n) {
+				return true
+			}
+		}
+		return false`, selector, sibling))
+	default:
+		return g.function("return " + g.fallback(s))
+	}
+}
+
+// simpleSelector returns the condition under which n does not match s.
+// An empty condition means n always matches, !ok means n never matches.
+func (g *generator) simpleSelector(s css.Selector) (condition string, ok bool) {
+	switch s := s.(type) {
+	case *css.UniversalSelector:
+		return "", true
+	case *css.ElementSelector:
+		if atom.Lookup([]byte(s.Element)) == 0 {
+			return fmt.Sprintf("n.Data != %q", s.Element), true
+		}
+		// nodes created by hand instead of the parser might not have an atom
+		g.imports["golang.org/x/net/html/atom"] = true
+		return fmt.Sprintf("n.DataAtom != atom.%s && (n.DataAtom != 0 || n.Data != %q)", atomName(s.Element), s.Element), true
+	case *css.IDSelector:
+		return g.attributeSelector(s.AttributeSelector)
+	case *css.ClassSelector:
+		return g.attributeSelector(s.AttributeSelector)
+	case *css.AttributeSelector:
+		return g.attributeSelector(s)
+	default:
+		return "!" + g.fallback(s), true
+	}
+}
+
+func (g *generator) attributeSelector(s *css.AttributeSelector) (string, bool) {
+	var condition string
+	switch v := fmt.Sprintf("%q", s.Value); s.Type {
+	case "":
+		g.helpers["attribute"] = true
+		return fmt.Sprintf("_, ok := cssgenAttribute(n, %q); !ok", s.Key), true
+	case "=":
+		condition = "v != " + v
+	case "~=":
+		g.helpers["includes"] = true
+		condition = fmt.Sprintf("!cssgenIncludes(v, %s)", v)
+	case "|=":
+		condition = fmt.Sprintf("v != %s && !strings.HasPrefix(v, %q)", v, s.Value+"-")
+	case "^=":
+		condition = fmt.Sprintf("!strings.HasPrefix(v, %s)", v)
+	case "$=":
+		condition = fmt.Sprintf("!strings.HasSuffix(v, %s)", v)
+	case "*=":
+		condition = fmt.Sprintf("!strings.Contains(v, %s)", v)
+	default:
+		return "!" + g.fallback(s), true
+	}
+	if (s.Type == "^=" || s.Type == "$=") && s.Value == "" {
+		return "", false
+	} else if s.Type != "=" {
+		g.imports["strings"] = true
+	}
+	g.helpers["attribute"] = true
+	return fmt.Sprintf("v, ok := cssgenAttribute(n, %q); !ok || %s", s.Key, condition), true
+}
+
+func (g *generator) fallback(s css.Selector) string {
+	g.helpers["fallback"], g.imports["sync"] = true, true
+	g.fallbacks = append(g.fallbacks, s.String())
+	return fmt.Sprintf("cssgenFallback%d.Match(n)", len(g.fallbacks)-1)
+}
+
+func (g *generator) function(body string) string {
+	name := fmt.Sprintf("match%s_%d", g.name, g.count)
+	g.count++
+	fmt.Fprintf(&g.functions, "func %s(n *html.Node) bool {\n%s\n}\n\n", name, body)
+	return name
+}
+
+// atomName returns the name of the constant for element in the atom package, e.g. AnnotationXml for annotation-xml.
+func atomName(element string) string {
+	name := []byte{}
+	for i := 0; i < len(element); i++ {
+		if element[i] == '-' {
+			continue
+		} else if i == 0 || element[i-1] == '-' {
+			name = append(name, byte(unicode.ToUpper(rune(element[i]))))
+		} else {
+			name = append(name, element[i])
+		}
+	}
+	return string(name)
+}
+
+func unexport(name string) string {
+	return string(unicode.ToLower(rune(name[0]))) + name[1:]
+}
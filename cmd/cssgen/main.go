@@ -0,0 +1,165 @@
+// cssgen compiles css selectors into specialized go functions implementing css.Selector.
+//
+// Selectors are read from //css:Name selector directives in a go file
+//
+//	//go:generate go run github.com/niklasfasching/css/cmd/cssgen -file=$GOFILE
+//	//css:Links a[href^="http"]
+//
+// or passed as Name=selector arguments together with -pkg and -o.
+// For each selector an exported variable Name of type css.Selector is generated,
+// as well as a test that checks it against the interpreted css.Compile result on the html files matched by -testdata.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/niklasfasching/css"
+)
+
+var (
+	file     = flag.String("file", "", "go file to read //css: directives from")
+	pkg      = flag.String("pkg", "", "package name of the generated code (defaults to the package of -file)")
+	output   = flag.String("o", "", "output file (defaults to -file with a _css.go suffix)")
+	testdata = flag.String("testdata", "testdata/*.html", "glob of html files the generated test compares matches on")
+)
+
+type directive struct {
+	name, selector string
+	compiled       css.Selector
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+	directives, err := readDirectives()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" && *file == "" {
+		log.Fatal("-o is required when not reading directives from -file")
+	} else if *output == "" {
+		*output = strings.TrimSuffix(*file, ".go") + "_css.go"
+	}
+	if *pkg == "" && *file != "" {
+		f, err := parser.ParseFile(token.NewFileSet(), *file, nil, parser.PackageClauseOnly)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*pkg = f.Name.Name
+	} else if *pkg == "" {
+		log.Fatal("-pkg is required when not reading directives from -file")
+	}
+	testOutput := strings.TrimSuffix(*output, ".go") + "_test.go"
+	if err := write(*output, generate(*pkg, directives)); err != nil {
+		log.Fatal(err)
+	}
+	if err := write(testOutput, generateTest(*pkg, *output, directives)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readDirectives() ([]directive, error) {
+	var lines []string
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "//css:") {
+				lines = append(lines, directiveArgument(line[len("//css:"):]))
+			}
+		}
+	}
+	lines = append(lines, flag.Args()...)
+	directives := make([]directive, len(lines))
+	for i, line := range lines {
+		d, err := parseDirective(line)
+		if err != nil {
+			return nil, err
+		}
+		directives[i] = d
+	}
+	return directives, nil
+}
+
+// directiveArgument converts the "Name selector" of a //css: directive into a Name=selector argument.
+// Name and selector are separated by any amount of whitespace (spaces or tabs).
+func directiveArgument(line string) string {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexFunc(line, unicode.IsSpace); i != -1 {
+		return line[:i] + "=" + strings.TrimSpace(line[i:])
+	}
+	return line
+}
+
+// parseDirective parses a Name=selector argument.
+func parseDirective(line string) (directive, error) {
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 || !isExportedIdentifier(parts[0]) {
+		return directive{}, fmt.Errorf("bad directive %q: expected Name selector", line)
+	}
+	compiled, err := css.Compile(parts[1])
+	if err != nil {
+		return directive{}, fmt.Errorf("bad directive %q: %s", line, err)
+	}
+	return directive{parts[0], strings.TrimSpace(parts[1]), compiled}, nil
+}
+
+func write(path string, src []byte) error {
+	formatted, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("%s: %s\n%s", path, err, src)
+	}
+	return ioutil.WriteFile(path, formatted, 0644)
+}
+
+func isExportedIdentifier(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || i != 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != "" && unicode.IsUpper([]rune(s)[0])
+}
+
+func generateTest(pkg, output string, directives []directive) []byte {
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "// Code generated by cssgen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	fmt.Fprintf(w, "import (\n\"os\"\n\"path/filepath\"\n\"reflect\"\n\"testing\"\n\n\"github.com/niklasfasching/css\"\n\"golang.org/x/net/html\"\n)\n\n")
+	fmt.Fprintf(w, "func Test%s(t *testing.T) {\n", testName(output))
+	fmt.Fprintf(w, "paths, err := filepath.Glob(%q)\nif err != nil || len(paths) == 0 {\nt.Fatalf(\"no test data: %%v\", err)\n}\n", *testdata)
+	fmt.Fprintf(w, "for _, path := range paths {\nf, err := os.Open(path)\nif err != nil {\nt.Fatal(err)\n}\n")
+	fmt.Fprintf(w, "document, err := html.Parse(f)\nf.Close()\nif err != nil {\nt.Fatal(err)\n}\n")
+	fmt.Fprintf(w, "for _, s := range []struct {\nname string\ngenerated css.Selector\nselector string\n}{\n")
+	for _, d := range directives {
+		fmt.Fprintf(w, "{%q, %s, %q},\n", d.name, d.name, d.selector)
+	}
+	fmt.Fprintf(w, "} {\nexpected, actual := css.All(css.MustCompile(s.selector), document), css.All(s.generated, document)\n")
+	fmt.Fprintf(w, "if !reflect.DeepEqual(actual, expected) {\nt.Errorf(\"%%s: %%s: %%s: got %%d nodes, expected %%d\", path, s.name, s.selector, len(actual), len(expected))\n}\n")
+	fmt.Fprintf(w, "}\n}\n}\n")
+	return w.Bytes()
+}
+
+func testName(output string) string {
+	name := "CSSGen"
+	for _, part := range strings.FieldsFunc(strings.TrimSuffix(filepath.Base(output), ".go"), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return name
+}
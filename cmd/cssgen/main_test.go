@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDirectives(t *testing.T) {
+	tests := []struct {
+		line, name, selector string
+	}{
+		{"Links a[href]", "Links", "a[href]"},
+		{"Links   a[href]", "Links", "a[href]"},
+		{"Links\ta[href]", "Links", "a[href]"},
+		{" \tItems \t ul  >  li:nth-child(2n + 1) \t", "Items", "ul  >  li:nth-child(2n + 1)"},
+		{"Titles\t[title=\"a  b\"]", "Titles", "[title=\"a  b\"]"},
+	}
+	for _, test := range tests {
+		d, err := parseDirective(directiveArgument(test.line))
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.line, err)
+		} else if d.name != test.name || d.selector != test.selector {
+			t.Errorf("%q: got %q %q, expected %q %q", test.line, d.name, d.selector, test.name, test.selector)
+		}
+	}
+	for _, line := range []string{"Links", "\tLinks\t", "links a", "Links a["} {
+		if _, err := parseDirective(directiveArgument(line)); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
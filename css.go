@@ -3,15 +3,33 @@
 package css
 
 import (
+	"sync"
+
 	"golang.org/x/net/html"
 )
 
 func Compile(selector string) (Selector, error) {
-	tokens, err := lex(selector)
+	return compile(selector, nil, 0)
+}
+
+// CompileWithSpans is like Compile and additionally returns the Spans of the nodes of the compiled selector.
+func CompileWithSpans(selector string) (Selector, *Spans, error) {
+	spans := &Spans{map[Selector]Span{}, map[Selector]Span{}, map[Selector]Span{}}
+	s, err := compile(selector, spans, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, spans, nil
+}
+
+// compile records the spans of the nodes relative to offset, the position of selector in the string it is part of.
+func compile(selector string, spans *Spans, offset int) (Selector, error) {
+	l, err := lex(selector)
+	defer l.release()
 	if err != nil {
 		return nil, err
 	}
-	return parse(tokens)
+	return parse(l.tokens, spans, offset)
 }
 
 func MustCompile(selector string) Selector {
@@ -23,27 +41,277 @@ func MustCompile(selector string) Selector {
 }
 
 func First(s Selector, n *html.Node) *html.Node {
-	if n.Type == html.ElementNode && s.Match(n) {
-		return n
+	q := newQuery(s)
+	defer q.release()
+	return q.first(n, q.filter(n))
+}
+
+func All(s Selector, n *html.Node) []*html.Node {
+	q := newQuery(s)
+	defer q.release()
+	return q.all(n, q.filter(n), nil)
+}
+
+// AllInTemplate returns the nodes in the contents of template matched by s - like template.content.querySelectorAll.
+// The contents are queried as their own root, i.e. combinators do not reach the template or its ancestors.
+// Use a MatchContext with the template as Scope for First and Count.
+func AllInTemplate(s Selector, template *html.Node) []*html.Node {
+	return (&MatchContext{Scope: template}).All(s, template)
+}
+
+// Count returns the number of nodes matched by s without collecting them.
+func Count(s Selector, n *html.Node) int {
+	q := newQuery(s)
+	defer q.release()
+	return q.count(n, q.filter(n))
+}
+
+// Exists reports whether s matches any node - stopping at the first one.
+func Exists(s Selector, n *html.Node) bool {
+	return First(s, n) != nil
+}
+
+// query holds the state shared by a single traversal of the document.
+// It is kept on the stack so that matching simple selectors does not allocate.
+type query struct {
+	selector Selector
+	context  *MatchContext
+	// ancestors contains the hashes required among the ancestors of a node for each branch of the selector.
+	// Zero branches means there are no requirements and the ancestor bloom filter is not maintained.
+	ancestors [4]hashes
+	branches  int
+	// id and class are required by the subject of the selector and checked before matching it in full.
+	id, class string
+	// shadow and templates make the traversal descend into declarative shadow roots and template contents.
+	shadow, templates bool
+	// scope is the Scope of the context - it is not matched itself but always descended into.
+	scope *html.Node
+	// parts contains the ::part branches of the selector - the only ones matched in the shadow trees of the
+	// hosts the traversal visits without entering shadow roots.
+	parts Selector
+	// pooled is set if the context was taken from contexts and has to be returned by release.
+	pooled bool
+}
+
+// contexts holds the MatchContexts of finished queries without one - reusing them (and the storage of their
+// caches) keeps queries for structural pseudo-classes like :nth-child from allocating.
+var contexts = sync.Pool{New: func() interface{} { return &MatchContext{} }}
+
+// defaultQuery visits the nodes a query without MatchContext visits - for traversals that do not take one.
+var defaultQuery = query{}
+
+func newQuery(s Selector) query {
+	return newContextQuery(nil, s)
+}
+
+// newContextQuery creates a query matching with c - or a new MatchContext if c is nil and s needs one.
+func newContextQuery(c *MatchContext, s Selector) query {
+	q := query{selector: s, context: c, shadow: c != nil && c.PierceShadowRoots, templates: c != nil && c.TemplateContents}
+	if !q.shadow {
+		q.parts = partBranches(s)
+	}
+	if c != nil {
+		q.scope = c.Scope
+	}
+	if c == nil && needsContext(s) {
+		q.context, q.pooled = contexts.Get().(*MatchContext), true
+	}
+	if !q.addBranches(s) {
+		q.branches = 0
+	}
+	if q.id, q.class, _ = subjectKey(s); q.id != "" {
+		// ids are unique - the candidate check rejects almost all nodes, maintaining the bloom filter does not pay off.
+		q.branches = 0
+	}
+	return q
+}
+
+// release returns the pooled context of the query - the query must not be used afterwards.
+func (q *query) release() {
+	if q.pooled {
+		q.context.reset()
+		contexts.Put(q.context)
+		q.context, q.pooled = nil, false
+	}
+}
+
+// addBranches adds the ancestor hashes of each branch of s and reports whether all of them have requirements.
+func (q *query) addBranches(s Selector) bool {
+	if u, ok := s.(*UnionSelector); ok {
+		return q.addBranches(u.SelectorA) && q.addBranches(u.SelectorB)
+	} else if q.branches == len(q.ancestors) {
+		return false
+	}
+	hs := &q.ancestors[q.branches]
+	ancestorHashes(s, hs)
+	q.branches++
+	return hs.n != 0
+}
+
+// filter returns the ancestor bloom filter for starting a traversal at n.
+func (q *query) filter(n *html.Node) bloomFilter {
+	if q.branches == 0 {
+		return bloomFilter{}
+	}
+	return ancestorFilter(n)
+}
+
+func (q *query) match(n *html.Node, f *bloomFilter) bool {
+	if n.Type != html.ElementNode || !q.candidate(n) {
+		return false
+	} else if q.branches == 0 {
+		return matchWith(q.context, q.selector, n)
+	}
+	for i := 0; i < q.branches; i++ {
+		if f.hasAll(&q.ancestors[i]) {
+			return matchWith(q.context, q.selector, n)
+		}
+	}
+	return false
+}
+
+// candidate checks whether n has the id or class required by the subject of the selector.
+func (q *query) candidate(n *html.Node) bool {
+	if q.id == "" && q.class == "" {
+		return true
+	}
+	for _, a := range n.Attr {
+		if q.id != "" && a.Key == "id" {
+			return a.Val == q.id
+		} else if q.id == "" && a.Key == "class" {
+			return includeMatch(a.Val, q.class)
+		}
+	}
+	return false
+}
+
+// enters reports whether the traversal visits n - declarative shadow roots are separate scopes.
+func (q *query) enters(n *html.Node) bool {
+	return q.shadow || !isShadowRoot(n)
+}
+
+// descends reports whether the traversal visits the children of n - template contents are not part of the document.
+func (q *query) descends(n *html.Node) bool {
+	return q.templates || !isTemplate(n) || isShadowRoot(n) || n == q.scope
+}
+
+// walk calls visit for the nodes matched by the query in document order - stopping as soon as visit returns false.
+func (q *query) walk(n *html.Node, f bloomFilter, visit func(*html.Node) bool) bool {
+	if n != q.scope && q.match(n, &f) && !visit(n) {
+		return false
+	} else if !q.descends(n) {
+		return true
+	}
+	if q.branches != 0 && n.Type == html.ElementNode && n.FirstChild != nil {
+		f.addNode(n)
 	}
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		if n := First(s, c); n != nil {
+		if q.enters(c) {
+			if !q.walk(c, f, visit) {
+				return false
+			}
+		} else if q.parts != nil && !q.walkParts(c, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkParts calls visit for the elements of the shadow tree of root matched by the ::part branches of the query.
+func (q *query) walkParts(root *html.Node, visit func(*html.Node) bool) bool {
+	return q.visitShadowTree(root, func(n *html.Node) bool { return !matchWith(q.context, q.parts, n) || visit(n) })
+}
+
+// visitShadowTree calls visit for the elements of the shadow tree of root that ::part exposes - stopping as soon
+// as visit returns false. Nested shadow trees are not exposed.
+func (q *query) visitShadowTree(root *html.Node, visit func(*html.Node) bool) bool {
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if isShadowRoot(c) {
+			continue
+		} else if c.Type == html.ElementNode && !visit(c) || q.descends(c) && !q.visitShadowTree(c, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *query) first(n *html.Node, f bloomFilter) (first *html.Node) {
+	q.walk(n, f, func(n *html.Node) bool { first = n; return false })
+	return first
+}
+
+func (q *query) all(n *html.Node, f bloomFilter, ns []*html.Node) []*html.Node {
+	q.walk(n, f, func(n *html.Node) bool { ns = append(ns, n); return true })
+	return ns
+}
+
+func (q *query) count(n *html.Node, f bloomFilter) (count int) {
+	q.walk(n, f, func(*html.Node) bool { count++; return true })
+	return count
+}
+
+// Matches reports whether n is an element node matched by s.
+func Matches(s Selector, n *html.Node) bool {
+	return isElementNode(n) && s.Match(n)
+}
+
+// Closest returns the first element matched by s starting at n and walking up its ancestors.
+func Closest(s Selector, n *html.Node) *html.Node {
+	for ; n != nil; n = n.Parent {
+		if Matches(s, n) {
 			return n
 		}
 	}
 	return nil
 }
 
-func All(s Selector, n *html.Node) []*html.Node {
-	return all(s, n, nil)
+// NextSibling returns the first following sibling element of n matched by s.
+func NextSibling(s Selector, n *html.Node) *html.Node {
+	return first(s, n, func(n *html.Node) *html.Node { return n.NextSibling })
+}
+
+// PrevSibling returns the first preceding sibling element of n matched by s.
+func PrevSibling(s Selector, n *html.Node) *html.Node {
+	return first(s, n, func(n *html.Node) *html.Node { return n.PrevSibling })
+}
+
+// NextSiblings returns the following sibling elements of n matched by s - nearest first.
+func NextSiblings(s Selector, n *html.Node) []*html.Node {
+	return until(s, nil, n, func(n *html.Node) *html.Node { return n.NextSibling })
+}
+
+// PrevSiblings returns the preceding sibling elements of n matched by s - nearest first.
+func PrevSiblings(s Selector, n *html.Node) []*html.Node {
+	return until(s, nil, n, func(n *html.Node) *html.Node { return n.PrevSibling })
 }
 
-func all(s Selector, n *html.Node, ns []*html.Node) []*html.Node {
-	if n.Type == html.ElementNode && s.Match(n) {
-		ns = append(ns, n)
+// Parents returns the ancestor elements of n matched by s - nearest first.
+func Parents(s Selector, n *html.Node) []*html.Node {
+	return until(s, nil, n, func(n *html.Node) *html.Node { return n.Parent })
+}
+
+// ParentsUntil returns the ancestor elements of n up to but excluding the first one matched by stop - nearest first.
+// A nil stop selector returns all ancestor elements.
+func ParentsUntil(stop Selector, n *html.Node) []*html.Node {
+	return until(&UniversalSelector{"*"}, stop, n, func(n *html.Node) *html.Node { return n.Parent })
+}
+
+func first(s Selector, n *html.Node, next func(*html.Node) *html.Node) *html.Node {
+	for n := next(n); n != nil; n = next(n) {
+		if Matches(s, n) {
+			return n
+		}
 	}
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		ns = all(s, c, ns)
+	return nil
+}
+
+func until(s, stop Selector, n *html.Node, next func(*html.Node) *html.Node) (ns []*html.Node) {
+	for n := next(n); n != nil; n = next(n) {
+		if stop != nil && Matches(stop, n) {
+			break
+		} else if Matches(s, n) {
+			ns = append(ns, n)
+		}
 	}
 	return ns
 }
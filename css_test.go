@@ -2,20 +2,24 @@ package css
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/bits"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/andybalholm/cascadia"
 	"github.com/ericchiang/css"
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 var updateTestData = flag.Bool("update-test-data", false, "update test data rather than actually running tests")
@@ -67,6 +71,1003 @@ func TestCSS(t *testing.T) {
 	}
 }
 
+func TestSelectorJSON(t *testing.T) {
+	for _, path := range htmlFiles() {
+		document, selectors := readHTML(path)
+		for _, selector := range selectors {
+			s, err := Compile(selector)
+			if err != nil {
+				continue
+			}
+			bs, err := json.Marshal(SelectorJSON{s})
+			if err != nil {
+				t.Errorf("%s: %s", selector, err)
+				continue
+			}
+			decoded := SelectorJSON{}
+			if err := json.Unmarshal(bs, &decoded); err != nil {
+				t.Errorf("%s: %s: %s", selector, bs, err)
+				continue
+			}
+			if actual, expected := interfacify(decoded.Selector), interfacify(s); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s\ngot:\n\t'%s'\n\nexpected:\n\t'%s'", selector, jsonify(actual), jsonify(expected))
+			}
+			if actual, expected := All(decoded.Selector, document), All(s, document); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", selector, renderHTML(actual), renderHTML(expected))
+			}
+		}
+	}
+	for _, x := range []struct{ selector, argument string }{
+		{"li:nth-child(2n+1)", `{"type":"nth","a":2,"b":1}`},
+		{":not(p, .a)", `{"type":"selector-list","selectors":[{"type":"union","selectors":[{"type":"sequence","selectors":[{"type":"element","element":"p"}]},{"type":"sequence","selectors":[{"type":"class","value":"a"}]}]}]}`},
+		{":contains(foo)", `{"type":"string","value":"foo"}`},
+		{":lang(en, de)", `{"type":"identifier","identifiers":["en","de"]}`},
+		{"x-card::part(title)", `{"type":"identifier","identifiers":["title"]}`},
+	} {
+		bs, _ := json.Marshal(SelectorJSON{MustCompile(x.selector)})
+		if !strings.Contains(string(bs), `"argument":`+x.argument) {
+			t.Errorf("%s: expected argument %s in %s", x.selector, x.argument, bs)
+		}
+	}
+	decoded := SelectorJSON{}
+	bs := `{"version": 1, "selector": {"type": "pseudo-function", "name": "nth-child", "argument": {"type": "nth", "a": 2, "b": 1}}}`
+	if err := json.Unmarshal([]byte(bs), &decoded); err != nil || decoded.Selector.String() != ":nth-child(2n+1)" {
+		t.Errorf("expected pseudo-function from typed argument: %v %s", decoded.Selector, err)
+	}
+	for _, bs := range []string{
+		`{"version": 1, "selector": {"type": "pseudo-function", "name": "nth-child", "argument": {"type": "foo"}}}`,
+		`{"version": 1, "selector": {"type": "pseudo-function", "name": "not", "argument": {"type": "selector-list"}}}`,
+		`{"version": 2, "selector": {"type": "universal"}}`,
+		`{"version": 1}`,
+		`{"version": 1, "selector": {"type": "foo"}}`,
+		`{"version": 1, "selector": {"type": "child", "selectors": [{"type": "universal"}]}}`,
+		`{"version": 1, "selector": {"type": "attribute", "key": "a", "matcher": "%="}}`,
+		`{"version": 1, "selector": {"type": "pseudo", "name": "foo"}}`,
+		`{"version": 1, "selector": {"type": "pseudo-function", "name": "nth-child", "args": "foo"}}`,
+		`{"version": 1, "selector": {"type": "sequence"}}`,
+		`{"version": 1, "selector": {"type": "sequence", "selectors": [{"type": "child", "selectors": [{"type": "universal"}, {"type": "universal"}]}]}}`,
+		`{"version": 1, "selector": {"type": "sequence", "selectors": [{"type": "sequence", "selectors": [{"type": "universal"}]}]}}`,
+	} {
+		if err := json.Unmarshal([]byte(bs), &SelectorJSON{}); err == nil {
+			t.Errorf("expected error for %s", bs)
+		}
+	}
+	if _, err := json.Marshal(SelectorJSON{MustCompileProgram("p")}); err == nil {
+		t.Errorf("expected error for unsupported selector type")
+	}
+	descendant := Combinators[" "]
+	delete(Combinators, " ")
+	defer func() { Combinators[" "] = descendant }()
+	if err := json.Unmarshal([]byte(`{"version": 1, "selector": {"type": "descendant", "selectors": [{"type": "universal"}, {"type": "universal"}]}}`), &SelectorJSON{}); err == nil {
+		t.Errorf("expected error for unregistered combinator")
+	}
+}
+
+func TestSpans(t *testing.T) {
+	PseudoFunctionExtensions["has"] = PseudoFunctionExtension{
+		Argument: RelativeSelectorListKind,
+		Compile: func(a Argument) (func(*MatchContext, *html.Node) bool, error) {
+			return a.(*RelativeSelectorArgument).Match, nil
+		},
+	}
+	defer delete(PseudoFunctionExtensions, "has")
+	selector := `div.a  >  p[href^="x"]:nth-child( 2n+1):empty, #b ~ *:not(.c + d, e), f:has( > g)`
+	s, spans, err := CompileWithSpans(selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	var walk func(Selector)
+	walk = func(s Selector) {
+		text := func(span Span) string { return selector[span.Start:span.End] }
+		switch s := s.(type) {
+		case *UnionSelector:
+			walk(s.SelectorA)
+			actual = append(actual, text(spans.CombinatorSpan(s)))
+			walk(s.SelectorB)
+		case *SubsequentSiblingSelector:
+			walk(s.Sibling)
+			actual = append(actual, text(spans.CombinatorSpan(s)))
+			walk(s.Selector)
+		case *NextSiblingSelector:
+			walk(s.Sibling)
+			actual = append(actual, text(spans.CombinatorSpan(s)))
+			walk(s.Selector)
+		case *ChildSelector:
+			walk(s.Parent)
+			actual = append(actual, text(spans.CombinatorSpan(s)))
+			walk(s.Selector)
+		case *SelectorSequence:
+			actual = append(actual, text(spans.Span(s)))
+			for _, s := range s.Selectors {
+				walk(s)
+			}
+		case *PseudoFunctionSelector:
+			actual = append(actual, text(spans.Span(s)), text(spans.ArgsSpan(s)))
+			switch a := s.Argument.(type) {
+			case *SelectorArgument:
+				walk(a.Selector)
+			case *RelativeSelectorArgument:
+				for _, r := range a.Selectors {
+					walk(r.Selector)
+				}
+			}
+		default:
+			actual = append(actual, text(spans.Span(s)))
+		}
+	}
+	walk(s)
+	expected := []string{"div.a", "div", ".a", ">", `p[href^="x"]:nth-child( 2n+1):empty`, "p", `[href^="x"]`,
+		":nth-child( 2n+1)", " 2n+1", ":empty", ",", "#b", "#b", "~", "*:not(.c + d, e)", "*",
+		":not(.c + d, e)", ".c + d, e", ".c", ".c", "+", "d", "d", ",", "e", "e", ",",
+		"f:has( > g)", "f", ":has( > g)", " > g", "g", "g"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got:\n\t'%#v'\n\nexpected:\n\t'%#v'", actual, expected)
+	}
+	if span := spans.Span(s); span != (Span{0, len(selector)}) {
+		t.Errorf("got %v for the span of the whole selector", span)
+	}
+	if s, spans, _ := CompileWithSpans("  p  "); spans.Span(s) != (Span{2, 3}) {
+		t.Errorf("expected span relative to untrimmed input, got %v", spans.Span(s))
+	}
+	if s, spans, _ := CompileWithSpans("x-card::slotted(.a)"); spans.Span(s) != (Span{0, 19}) || spans.ArgsSpan(s) != (Span{16, 18}) ||
+		spans.Span(s.(*PseudoElementSelector).Argument.(*SelectorArgument).Selector) != (Span{16, 18}) {
+		t.Errorf("got unexpected spans for ::slotted(.a): %v %v", spans.Span(s), spans.ArgsSpan(s))
+	}
+	if s := MustCompile("p"); (*Spans)(nil).Span(s) != (Span{}) {
+		t.Errorf("expected zero span without spans")
+	}
+}
+
+func TestArguments(t *testing.T) {
+	for _, x := range []struct {
+		selector string
+		expected Argument
+	}{
+		{":nth-child(odd)", &NthArgument{2, 1}},
+		{":nth-last-child(-n + 3)", &NthArgument{-1, 3}},
+		{":nth-of-type(5)", &NthArgument{0, 5}},
+		{`:contains("a b")`, &StringArgument{"a b"}},
+		{":contains(foo)", &StringArgument{"foo"}},
+		{`:contains('a "b"')`, &StringArgument{`a "b"`}},
+		{`:contains("a\"b\\")`, &StringArgument{`a"b\`}},
+		{`:contains(\66 oo)`, &StringArgument{"foo"}},
+		{":lang(en, de-CH)", &IdentifierArgument{[]string{"en", "de-CH"}}},
+		{":not(.a, #b)", &SelectorArgument{MustCompile(".a, #b")}},
+	} {
+		actual := MustCompile(x.selector).(*SelectorSequence).Selectors[0].(*PseudoFunctionSelector).Argument
+		if !reflect.DeepEqual(interfacify(actual), interfacify(x.expected)) || actual.String() != x.expected.String() {
+			t.Errorf("%s: got %s (%s), expected %s (%s)", x.selector, jsonify(actual), actual, jsonify(x.expected), x.expected)
+		}
+	}
+	for _, selector := range []string{`:contains('a "b"')`, `:contains("a\"b\\")`} {
+		s := MustCompile(selector)
+		if roundtripped := MustCompile(s.String()); !reflect.DeepEqual(interfacify(roundtripped), interfacify(s)) {
+			t.Errorf("%s: bad round trip via %s", selector, s)
+		}
+	}
+	document, _ := html.Parse(strings.NewReader(`<div lang="EN-us"><p id="a"></p></div><div lang="de"><p id="b" lang="fr"></p><p id="c"></p></div>`))
+	for selector, expected := range map[string]int{"p:lang(en)": 1, "p:lang(en-US)": 1, "p:lang(de, fr)": 2, "p:lang(e)": 0} {
+		if actual := len(All(MustCompile(selector), document)); actual != expected {
+			t.Errorf("%s: got %d nodes, expected %d", selector, actual, expected)
+		}
+	}
+	if a, err := parseIdentifierArgument(" en,de "); err != nil || a.String() != "en, de" {
+		t.Errorf("got %v (%v) for identifier list", a, err)
+	}
+	if _, err := parseIdentifierArgument("en,,de"); err == nil {
+		t.Errorf("expected error for empty identifier")
+	}
+}
+
+func TestPseudoFunctionExtensions(t *testing.T) {
+	PseudoFunctionExtensions["has"] = PseudoFunctionExtension{RelativeSelectorListKind, func(a Argument) (func(*MatchContext, *html.Node) bool, error) {
+		return func(c *MatchContext, n *html.Node) bool { return a.(*RelativeSelectorArgument).Match(c, n) }, nil
+	}}
+	PseudoFunctionExtensions["has-text"] = PseudoFunctionExtension{StringKind, func(a Argument) (func(*MatchContext, *html.Node) bool, error) {
+		return func(c *MatchContext, n *html.Node) bool {
+			return strings.TrimSpace(c.Text(n)) == a.(*StringArgument).Value
+		}, nil
+	}}
+	PseudoFunctionExtensions["depth"] = PseudoFunctionExtension{NumberKind, func(a Argument) (func(*MatchContext, *html.Node) bool, error) {
+		depth := a.(*NumberArgument).Value
+		if depth < 0 {
+			return nil, fmt.Errorf("bad depth: %v", depth)
+		}
+		return func(c *MatchContext, n *html.Node) bool { return float64(len(Parents(MustCompile("*"), n))) == depth }, nil
+	}}
+	PseudoFunctionExtensions["lang-in"] = PseudoFunctionExtension{IdentifierKind, func(a Argument) (func(*MatchContext, *html.Node) bool, error) {
+		return func(c *MatchContext, n *html.Node) bool {
+			for _, l := range a.(*IdentifierArgument).Identifiers {
+				if c.Match(MustCompile("[lang|="+l+"]"), n) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}}
+	PseudoClassExtensions["second-child"] = func(c *MatchContext, n *html.Node) bool { return c.Match(MustCompile(":nth-child(2)"), n) }
+	defer func() {
+		for _, name := range []string{"has", "has-text", "depth", "lang-in"} {
+			delete(PseudoFunctionExtensions, name)
+		}
+		delete(PseudoClassExtensions, "second-child")
+	}()
+	document, _ := html.Parse(strings.NewReader(`
+      <div id="a" lang="en-US"><p id="b">foo</p><img id="c"></div>
+      <div id="d" lang="de"><span><img id="e"></span></div>
+      <p id="f">bar</p><p id="g"></p>`))
+	for _, x := range []struct {
+		selector string
+		expected []string
+	}{
+		{"div:has(> img)", []string{"a"}},
+		{"div:has(img)", []string{"a", "d"}},
+		{"div:has(span > img, > p)", []string{"a", "d"}},
+		{"p:has(+ p)", []string{"f"}},
+		{"p:has(~ img)", []string{"b"}},
+		{":has-text(foo)", []string{"a", "b"}},
+		{"img:depth(3)", []string{"c"}},
+		{":lang-in(de, fr)", []string{"d"}},
+		{"[id]:second-child", []string{"c", "d"}},
+	} {
+		s, err := Compile(x.selector)
+		if err != nil {
+			t.Errorf("%s: %s", x.selector, err)
+			continue
+		}
+		var actual []string
+		for _, n := range All(s, document) {
+			actual = append(actual, n.Attr[0].Val)
+		}
+		if !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s: got %v, expected %v", x.selector, actual, x.expected)
+		}
+		bs, _ := json.Marshal(SelectorJSON{s})
+		decoded := SelectorJSON{}
+		if err := json.Unmarshal(bs, &decoded); err != nil || len(All(decoded.Selector, document)) != len(x.expected) {
+			t.Errorf("%s: bad json round trip: %s", x.selector, err)
+		}
+	}
+	for _, selector := range []string{":depth(-1)", ":depth(one)", ":lang-in(a b)", ":has(> )", ":has(a, )"} {
+		if _, err := Compile(selector); err == nil {
+			t.Errorf("%s: expected error", selector)
+		}
+	}
+	f := First(MustCompile("#f"), document)
+	for name, args := range map[string]string{"not": "div", "nth-child": "odd", "nth-of-type": "1", "contains": "bar"} {
+		if match, err := PseudoFunctions[name](args); err != nil || !match(f) {
+			t.Errorf("legacy PseudoFunctions[%q](%q): expected match: %v", name, args, err)
+		}
+	}
+	if !PseudoClasses["first-of-type"](f) || PseudoClasses["only-child"](f) {
+		t.Errorf("legacy PseudoClasses: bad structural matches")
+	}
+}
+
+func TestCustomTokens(t *testing.T) {
+	Combinators[">>>"] = Combinators[" "]
+	Combinators["/deep/"] = Combinators[">"]
+	Matchers["!="] = func(av, sv string) bool { return av != sv }
+	Matchers["~/"] = func(av, sv string) bool { return strings.HasPrefix(av, sv+"/") }
+	Combinators["in"] = Combinators[" "]
+	defer func() {
+		delete(Combinators, "in")
+		delete(Combinators, ">>>")
+		delete(Combinators, "/deep/")
+		delete(Matchers, "!=")
+		delete(Matchers, "~/")
+	}()
+	document, _ := html.Parse(strings.NewReader(`<div><p><a id="a" href="x/y"></a></p><a id="b" href="x"></a></div>`))
+	for _, x := range []struct {
+		selector string
+		expected []string
+	}{
+		{"div >>> a", []string{"a", "b"}},
+		{"div/deep/a", []string{"b"}},
+		{"div > p > a", []string{"a"}},
+		{"a[href!=x]", []string{"a"}},
+		{"a[href~/x]", []string{"a"}},
+		{"p ~ a[href=x]", []string{"b"}},
+		{"div in a", []string{"a", "b"}},
+		{"input, a[href=x]", []string{"b"}},
+		{"p in-a", nil},
+	} {
+		s, err := Compile(x.selector)
+		if err != nil {
+			t.Errorf("%s: %s", x.selector, err)
+			continue
+		}
+		var actual []string
+		for _, n := range All(s, document) {
+			for _, a := range n.Attr {
+				if a.Key == "id" {
+					actual = append(actual, a.Val)
+				}
+			}
+		}
+		if !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s: got %v, expected %v", x.selector, actual, x.expected)
+		}
+	}
+	// replacing a key keeps the number of keys - the lexer only notices with RegistryChanged
+	delete(Combinators, "in")
+	Combinators["on"] = Combinators[" "]
+	defer delete(Combinators, "on")
+	RegistryChanged()
+	if ns := All(MustCompile("div on a"), document); len(ns) != 2 {
+		t.Errorf("expected registered combinator to be lexed after RegistryChanged: %d", len(ns))
+	} else if ns := All(MustCompile("div in a"), document); len(ns) != 0 {
+		t.Errorf("expected removed combinator not to be lexed after RegistryChanged: %d", len(ns))
+	}
+}
+
+func TestElementState(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`
+      <form id="form"><input id="name"><button id="submit"></button></form>
+      <a id="link" href="/"></a> <video id="a"></video> <audio id="b"></audio>`))
+	states := map[string]State{"name": Focus, "submit": Hover, "link": Visited, "a": Playing}
+	c := &MatchContext{State: ElementStateFunc(func(n *html.Node, state State) bool {
+		for _, a := range n.Attr {
+			if a.Key == "id" {
+				return states[a.Val] == state
+			}
+		}
+		return false
+	})}
+	ids := func(ns []*html.Node) (out []string) {
+		for _, n := range ns {
+			for _, a := range n.Attr {
+				if a.Key == "id" {
+					out = append(out, a.Val)
+				}
+			}
+		}
+		return out
+	}
+	for _, x := range []struct {
+		selector            string
+		expected, stateless []string
+	}{
+		{":focus", []string{"name"}, nil},
+		{":focus-within", []string{"form", "name"}, nil},
+		{"form:focus-within > button", []string{"submit"}, nil},
+		{":hover", []string{"submit"}, nil},
+		{":visited", []string{"link"}, nil},
+		{":playing", []string{"a"}, nil},
+		{":paused", []string{"b"}, []string{"a", "b"}},
+		{":active, :focus-visible", nil, nil},
+	} {
+		s, err := Compile(x.selector)
+		if err != nil {
+			t.Errorf("%s: %s", x.selector, err)
+			continue
+		}
+		if actual := ids(c.All(s, document)); !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s: got %v, expected %v", x.selector, actual, x.expected)
+		}
+		if actual := ids(All(s, document)); !reflect.DeepEqual(actual, x.stateless) {
+			t.Errorf("%s without state: got %v, expected %v", x.selector, actual, x.stateless)
+		}
+	}
+	other, _ := html.Parse(strings.NewReader(`<div id="other"><p><input id="name"></p></div>`))
+	if actual := ids(c.All(MustCompile("div:focus-within"), other)); !reflect.DeepEqual(actual, []string{"other"}) {
+		t.Errorf(":focus-within in another document: got %v", actual)
+	}
+}
+
+type customSelector struct{}
+
+func (customSelector) Match(n *html.Node) bool { return n.Data == "p" }
+func (customSelector) String() string          { return ":custom" }
+
+func TestMatchWith(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`<div><p><input></p></div>`))
+	input := First(MustCompile("input"), document)
+	c := &MatchContext{State: ElementStateFunc(func(n *html.Node, state State) bool { return n == input && state == Focus })}
+	s := MustCompile("div > p:focus-within > input:focus").(ContextSelector)
+	if !s.MatchWith(c, input) {
+		t.Errorf("%s: expected MatchWith to match with state", s)
+	} else if s.Match(input) {
+		t.Errorf("%s: expected Match not to match without state", s)
+	}
+	custom := &ChildSelector{Parent: customSelector{}, Selector: MustCompile("input:focus")}
+	if !custom.MatchWith(c, input) || custom.Match(input) {
+		t.Errorf("%s: expected custom selectors to be matched via Match", custom)
+	}
+}
+
+func TestShadowDOM(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`
+      <x-card id="card" class="dark">
+        <template shadowrootmode="open">
+          <header id="header" part="title main"><slot id="title" name="title"></slot></header>
+          <slot id="default"></slot>
+          <p id="secret"></p>
+          <x-inner id="inner"><template shadowrootmode="open"><b id="deep" part="title"></b></template></x-inner>
+        </template>
+        <h1 id="h1" slot="title"></h1>
+        <p id="p"></p>
+      </x-card>`))
+	ids := func(ns []*html.Node) (out []string) {
+		for _, n := range ns {
+			out = append(out, attribute(n, "id"))
+		}
+		return out
+	}
+	for _, x := range []struct {
+		selector string
+		pierce   bool
+		expected []string
+	}{
+		{"template, header", false, nil},
+		{"x-card > p", false, []string{"p"}},
+		{":host", false, nil},
+		{":host(.dark)", false, nil},
+		{":host-context(body)", false, nil},
+		{"slot::slotted(h1)", false, []string{"h1"}},
+		{"#default::slotted(*)", false, []string{"p"}},
+		{"header > slot::slotted(*)", false, []string{"h1"}},
+		{"x-card::part(title)", false, []string{"header"}},
+		{"::part(main title)", false, []string{"header"}},
+		{"*::part(title)", false, []string{"header"}},
+		{"p, x-card::part(title)", false, []string{"header", "p"}},
+		{"x-card::part(title), p, *::part(main)", false, []string{"header", "p"}},
+		{"p, x-inner::part(title)", false, []string{"p"}},
+		{"header", true, []string{"header"}},
+		{"p", true, []string{"secret", "p"}},
+		{"*::part(title)", true, []string{"header", "deep"}},
+		{":host", true, nil},
+	} {
+		s, err := Compile(x.selector)
+		if err != nil {
+			t.Errorf("%s: %s", x.selector, err)
+			continue
+		}
+		if actual := ids((&MatchContext{PierceShadowRoots: x.pierce}).All(s, document)); !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s: got %v, expected %v", x.selector, actual, x.expected)
+		}
+		if !x.pierce && s.String() != strings.Replace(x.selector, "::part(main title)", "*::part(main title)", 1) {
+			t.Errorf("%s: bad string: %s", x.selector, s)
+		}
+	}
+	bs, _ := json.Marshal(SelectorJSON{MustCompile("slot::slotted(h1), x-card::part(title)")})
+	if decoded := (SelectorJSON{}); json.Unmarshal(bs, &decoded) != nil || decoded.Selector.String() != "slot::slotted(h1), x-card::part(title)" {
+		t.Errorf("bad json round trip: %s", bs)
+	} else if actual := ids(All(decoded.Selector, document)); !reflect.DeepEqual(actual, []string{"header", "h1"}) {
+		t.Errorf("bad json round trip: %s: got %v", bs, actual)
+	}
+	if ns, _ := AllParallel(context.Background(), MustCompile("header"), document, 4); len(ns) != 0 {
+		t.Errorf("AllParallel: expected shadow roots to be skipped, got %v", ids(ns))
+	}
+	if ns, _ := AllParallel(context.Background(), MustCompile("p, x-card::part(title)"), document, 4); !reflect.DeepEqual(ids(ns), []string{"header", "p"}) {
+		t.Errorf("AllParallel: expected only ::part to enter shadow roots, got %v", ids(ns))
+	}
+	card := First(MustCompile("#card"), document)
+	inner := First(MustCompile("#inner"), shadowRoot(card))
+	for i, x := range []struct {
+		selector string
+		scope    *html.Node
+		expected []bool
+	}{
+		{":host", shadowRoot(card), []bool{true, false}},
+		{":host", First(MustCompile("#header"), shadowRoot(card)), []bool{true, false}},
+		{":host", shadowRoot(inner), []bool{false, true}},
+		{":host", nil, []bool{false, false}},
+		{":host(.dark)", shadowRoot(card), []bool{true, false}},
+		{":host(.light)", shadowRoot(card), []bool{false, false}},
+		{":host-context(body)", shadowRoot(card), []bool{true, false}},
+		{":host-context(body)", shadowRoot(inner), []bool{false, true}},
+	} {
+		c, s := &MatchContext{Scope: x.scope}, MustCompile(x.selector)
+		if actual := []bool{c.Match(s, card), c.Match(s, inner)}; !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%d: %s: got %v, expected %v", i, x.selector, actual, x.expected)
+		}
+	}
+	if ns := (&MatchContext{Scope: shadowRoot(card)}).All(MustCompile(":host"), shadowRoot(card)); len(ns) != 0 {
+		t.Errorf(":host: expected no matches inside the shadow tree, got %v", ids(ns))
+	}
+	c := &MatchContext{PierceShadowRoots: true}
+	if n := c.First(MustCompile("#header"), document); c.Text(n) != "" {
+		t.Errorf("bad text in shadow tree: %q", c.Text(n))
+	} else if _, ok := c.texts[n]; !ok {
+		t.Errorf("expected cached text for shadow trees")
+	}
+	for _, selector := range []string{"x-card::part(title) b", "x-card::part(title).x", "p::before", "x-card::part()", "::slotted(", "x-card::part(title)::part(x)"} {
+		if _, err := Compile(selector); err == nil {
+			t.Errorf("%s: expected error", selector)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`
+      <div id="outer">
+        <template id="t"><p id="a"><b id="b">hidden</b></p><template id="nested"><i id="i"></i></template></template>
+        <p id="c"></p>
+      </div>`))
+	ids := func(ns []*html.Node) (out []string) {
+		for _, n := range ns {
+			out = append(out, attribute(n, "id"))
+		}
+		return out
+	}
+	template := First(MustCompile("#t"), document)
+	for _, x := range []struct {
+		selector                          string
+		expected, withContents, inContent []string
+	}{
+		{"template", []string{"t"}, []string{"t", "nested"}, []string{"nested"}},
+		{"p", []string{"c"}, []string{"a", "c"}, []string{"a"}},
+		{"div b", nil, []string{"b"}, nil},
+		{"p > b", nil, []string{"b"}, []string{"b"}},
+		{"template > p", nil, []string{"a"}, nil},
+		{"[id]:first-child", []string{"outer", "t"}, []string{"outer", "t", "a", "b", "i"}, []string{"a", "b"}},
+		{"[id]:contains(hidden)", nil, []string{"outer", "t", "a", "b"}, []string{"a", "b"}},
+		{"p, i", []string{"c"}, []string{"a", "i", "c"}, []string{"a"}},
+	} {
+		s := MustCompile(x.selector)
+		if actual := ids(All(s, document)); !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s: got %v, expected %v", x.selector, actual, x.expected)
+		}
+		if actual := ids(NewIndex(document).All(s)); !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s with index: got %v, expected %v", x.selector, actual, x.expected)
+		}
+		if actual := ids(NewNFA(s).All(document)); !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s with nfa: got %v, expected %v", x.selector, actual, x.expected)
+		}
+		if actual := len(NewSelectorSet(s).All(document)); actual != len(x.expected) {
+			t.Errorf("%s with selector set: got %d nodes, expected %d", x.selector, actual, len(x.expected))
+		}
+		if actual := ids((&MatchContext{TemplateContents: true}).All(s, document)); !reflect.DeepEqual(actual, x.withContents) {
+			t.Errorf("%s with template contents: got %v, expected %v", x.selector, actual, x.withContents)
+		}
+		if actual := ids(AllInTemplate(s, template)); !reflect.DeepEqual(actual, x.inContent) {
+			t.Errorf("%s in template: got %v, expected %v", x.selector, actual, x.inContent)
+		}
+		c := &MatchContext{Scope: template}
+		if actual := c.Count(s, template); actual != len(x.inContent) {
+			t.Errorf("%s in template: got count %d, expected %d", x.selector, actual, len(x.inContent))
+		}
+		if actual := c.First(s, template); len(x.inContent) != 0 && attribute(actual, "id") != x.inContent[0] || len(x.inContent) == 0 && actual != nil {
+			t.Errorf("%s in template: got first %v, expected %v", x.selector, actual, x.inContent)
+		}
+	}
+	if text := NewSelection(First(MustCompile("#outer"), document)).Text(); strings.Contains(text, "hidden") {
+		t.Errorf("expected text without template contents, got %q", text)
+	}
+	c := &MatchContext{Scope: template}
+	if n := c.First(MustCompile(":contains(hidden)"), template); n != template.FirstChild || c.Text(n) != "hidden" {
+		t.Errorf("bad text in template: %v", n)
+	} else if _, ok := c.texts[n.FirstChild]; !ok {
+		t.Errorf("expected cached text for template contents")
+	} else if text := c.Text(First(MustCompile("#outer"), document)); strings.Contains(text, "hidden") {
+		t.Errorf("expected text without template contents, got %q", text)
+	}
+}
+
+func TestSelection(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`
+      <ul id="fruits"><li class="apple">Apple</li><li class="pear"><b>Pear</b></li><li class="orange">Orange</li></ul>`))
+	doc := NewSelection(document)
+	names := func(s *Selection) []string {
+		return s.Map(func(_ int, s *Selection) string {
+			if class, ok := s.Attr("class"); ok {
+				return class
+			}
+			return s.Nodes[0].Data
+		})
+	}
+	for _, x := range []struct {
+		name     string
+		actual   *Selection
+		expected []string
+	}{
+		{"Find", doc.Find("li"), []string{"apple", "pear", "orange"}},
+		{"Find descendants only", doc.Find("ul").Find("ul, li"), []string{"apple", "pear", "orange"}},
+		{"Filter", doc.Find("li").Filter(".pear, .orange"), []string{"pear", "orange"}},
+		{"Not", doc.Find("li").Not(".pear"), []string{"apple", "orange"}},
+		{"Has", doc.Find("li").Has("b"), []string{"pear"}},
+		{"Find structural", doc.Find("ul").Find("li:nth-child(n+2):contains(r)"), []string{"pear", "orange"}},
+		{"Has structural", doc.Find("body").Has("li:last-child:contains(Orange)"), []string{"body"}},
+		{"Parent", doc.Find("li").Parent(), []string{"ul"}},
+		{"Parents", doc.Find("b").Parents(), []string{"pear", "ul", "body", "html"}},
+		{"Children", doc.Find("ul").Children(), []string{"apple", "pear", "orange"}},
+		{"Siblings", doc.Find(".pear").Siblings(), []string{"apple", "orange"}},
+		{"Eq", doc.Find("li").Eq(1), []string{"pear"}},
+		{"Eq negative", doc.Find("li").Eq(-3), []string{"apple"}},
+		{"Eq out of range", doc.Find("li").Eq(3), []string{}},
+		{"First", doc.Find("li").First(), []string{"apple"}},
+		{"Last", doc.Find("li").Last(), []string{"orange"}},
+		{"Find invalid", doc.Find("li["), []string{}},
+		{"Filter invalid", doc.Find("li").Filter(":foo"), []string{}},
+		{"Not invalid", doc.Find("li").Not("li >"), []string{}},
+		{"Has invalid", doc.Find("li").Has("::foo"), []string{}},
+	} {
+		if actual := names(x.actual); !reflect.DeepEqual(actual, x.expected) {
+			t.Errorf("%s: got %v, expected %v", x.name, actual, x.expected)
+		}
+	}
+	if text := doc.Find("li").Text(); text != "ApplePearOrange" {
+		t.Errorf("Text: got %q", text)
+	}
+	if html, err := doc.Find("li").Eq(1).Html(); err != nil || html != "<b>Pear</b>" {
+		t.Errorf("Html: got %q, %v", html, err)
+	}
+	if _, ok := doc.Find("li").Attr("id"); ok {
+		t.Errorf("Attr: expected missing attribute")
+	}
+	var indexes []int
+	doc.Find("li").Each(func(i int, s *Selection) { indexes = append(indexes, i) })
+	if !reflect.DeepEqual(indexes, []int{0, 1, 2}) {
+		t.Errorf("Each: got %v", indexes)
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	document, err := html.Parse(strings.NewReader(`
+      <div class="outer"><section class="inner">
+        <p id="a">a</p> <p id="b" class="x">b</p> <span id="c">c</span> <p id="d" class="x">d</p>
+      </section></div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := First(MustCompile("#c"), document)
+	ids := func(ns ...*html.Node) (out []string) {
+		for _, n := range ns {
+			if n == nil {
+				out = append(out, "")
+			} else if len(n.Attr) != 0 && n.Attr[0].Key == "id" {
+				out = append(out, "#"+n.Attr[0].Val)
+			} else {
+				out = append(out, n.Data)
+			}
+		}
+		return out
+	}
+	for _, test := range []struct {
+		name     string
+		actual   []*html.Node
+		expected []string
+	}{
+		{"Closest", []*html.Node{Closest(MustCompile("section, div"), c)}, []string{"section"}},
+		{"Closest self", []*html.Node{Closest(MustCompile("span"), c)}, []string{"#c"}},
+		{"NextSibling", []*html.Node{NextSibling(MustCompile(".x"), c)}, []string{"#d"}},
+		{"PrevSibling", []*html.Node{PrevSibling(MustCompile(".x"), c)}, []string{"#b"}},
+		{"PrevSibling none", []*html.Node{PrevSibling(MustCompile("span"), c)}, []string{""}},
+		{"NextSiblings", NextSiblings(MustCompile("p"), First(MustCompile("#a"), document)), []string{"#b", "#d"}},
+		{"PrevSiblings", PrevSiblings(MustCompile("p"), c), []string{"#b", "#a"}},
+		{"Parents", Parents(MustCompile("[class]"), c), []string{"section", "div"}},
+		{"ParentsUntil", ParentsUntil(MustCompile("div"), c), []string{"section"}},
+		{"ParentsUntil nil", ParentsUntil(nil, c), []string{"section", "div", "body", "html"}},
+	} {
+		if actual := ids(test.actual...); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", test.name, actual, test.expected)
+		}
+	}
+	if !Matches(MustCompile("span"), c) || Matches(MustCompile("span"), c.FirstChild) {
+		t.Errorf("Matches: bad result for element / text node")
+	}
+}
+
+func TestSubjectCandidates(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`
+      <div id="x" class="a b"><p id="y" class="a">1</p><p class="b c" id="z">2</p></div>
+      <p class="ab">3</p><span class="a">4</span><p id="x-y" class="a">5</p>`))
+	var matchAll func(Selector, *html.Node, []*html.Node) []*html.Node
+	matchAll = func(s Selector, n *html.Node, ns []*html.Node) []*html.Node {
+		if Matches(s, n) {
+			ns = append(ns, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			ns = matchAll(s, c, ns)
+		}
+		return ns
+	}
+	for _, selector := range []string{
+		"#x", "#y", "#missing", "p#y", "span#y", "div#x .a", "#x > #z", "#x-y", "#y.a", "#y.missing",
+		".a", ".b", ".c", ".missing", "p.a", ".a.b", ".b.c", "div .a", "div > .b", ".a:not(#y)", "#x, .c", ".a ~ #x-y",
+	} {
+		s := MustCompile(selector)
+		expected := matchAll(s, document, nil)
+		if actual := All(s, document); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: All got %v, expected %v", selector, renderHTML(actual), renderHTML(expected))
+		}
+		if actual := Count(s, document); actual != len(expected) {
+			t.Errorf("%s: Count got %d, expected %d", selector, actual, len(expected))
+		}
+		var first []*html.Node
+		if n := First(s, document); n != nil {
+			first = []*html.Node{n}
+		}
+		if len(expected) > 1 {
+			expected = expected[:1]
+		}
+		if !reflect.DeepEqual(first, expected) {
+			t.Errorf("%s: First got %v, expected %v", selector, renderHTML(first), renderHTML(expected))
+		}
+	}
+}
+
+func TestSelectorSet(t *testing.T) {
+	for _, path := range htmlFiles() {
+		document, selectors := readHTML(path)
+		var compiled []Selector
+		for _, selector := range selectors {
+			if s, err := Compile(selector); err == nil {
+				compiled = append(compiled, s)
+			}
+		}
+		expected := map[*html.Node][]int{}
+		for i, s := range compiled {
+			for _, n := range All(s, document) {
+				expected[n] = append(expected[n], i)
+			}
+		}
+		if actual := NewSelectorSet(compiled...).All(document); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", path, actual, expected)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	for _, path := range htmlFiles() {
+		document, selectors := readHTML(path)
+		index := NewIndex(document)
+		for _, selector := range selectors {
+			s, err := Compile(selector)
+			if err != nil {
+				continue
+			}
+			if actual, expected := index.All(s), All(s, document); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: %s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", path, selector, renderHTML(actual), renderHTML(expected))
+			}
+			if actual, expected := index.First(s), First(s, document); actual != expected {
+				t.Errorf("%s: %s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", path, selector, actual, expected)
+			}
+		}
+	}
+	document, _ := html.Parse(strings.NewReader(`<p id="a"></p>`))
+	index, s := NewIndex(document), MustCompile("#b")
+	First(MustCompile("#a"), document).Attr[0].Val = "b"
+	if n := index.First(s); n != nil {
+		t.Errorf("expected stale index to not find #b")
+	}
+	if index.Invalidate(); index.First(s) == nil {
+		t.Errorf("expected invalidated index to find #b")
+	}
+}
+
+func TestElementAtoms(t *testing.T) {
+	document, _ := html.Parse(strings.NewReader(`<my-element></my-element><p></p>`))
+	checkbox := &html.Node{Type: html.ElementNode, Data: "input", Attr: []html.Attribute{{Key: "checked"}}}
+	// the names differ from the atoms - only a comparison of the atoms matches them
+	parent, renamed := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}, &html.Node{}
+	for _, data := range []string{"a", "b"} {
+		renamed = &html.Node{Type: html.ElementNode, Data: data, DataAtom: atom.P}
+		parent.AppendChild(renamed)
+	}
+	for _, x := range []struct {
+		selector string
+		n        *html.Node
+		expected bool
+	}{
+		{"my-element", First(MustCompile("body > :first-child"), document), true},
+		{"p", First(MustCompile("body > :last-child"), document), true},
+		{"div", First(MustCompile("body > :last-child"), document), false},
+		{"div", &html.Node{Type: html.ElementNode, Data: "div"}, true},
+		{"input:checked", checkbox, true},
+		{"input:checked", &html.Node{Type: html.ElementNode, Data: "select", Attr: checkbox.Attr}, false},
+		{"p", renamed, true},
+		{"b", renamed, false},
+		{"p:last-child", renamed, true},
+		{"p:nth-of-type(2)", renamed, true},
+		{"p:only-of-type", renamed, false},
+	} {
+		if actual := MustCompile(x.selector).Match(x.n); actual != x.expected {
+			t.Errorf("%s: got %v for %#v, expected %v", x.selector, actual, x.n, x.expected)
+		}
+		if actual := MustCompileProgram(x.selector).Match(x.n); actual != x.expected {
+			t.Errorf("%s (program): got %v for %#v, expected %v", x.selector, actual, x.n, x.expected)
+		}
+	}
+}
+
+func TestProgram(t *testing.T) {
+	for _, path := range htmlFiles() {
+		document, selectors := readHTML(path)
+		for _, selector := range selectors {
+			p, err := CompileProgram(selector)
+			if err != nil {
+				continue
+			}
+			bs, err := p.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &Program{}
+			if err := decoded.UnmarshalBinary(bs); err != nil {
+				t.Errorf("%s: %s: %s", path, selector, err)
+				continue
+			}
+			expected := All(MustCompile(selector), document)
+			for _, p := range []*Program{p, decoded} {
+				if actual := All(p, document); !reflect.DeepEqual(actual, expected) {
+					t.Errorf("%s: %s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", path, selector, renderHTML(actual), renderHTML(expected))
+				}
+			}
+		}
+	}
+	document, _ := html.Parse(strings.NewReader(`<div><p><a></a><b></b></p></div>`))
+	s := &DescendantSelector{MustCompile("div"), MustCompile("a, p > b")}
+	if actual, expected := All(NewProgram(s), document), All(s, document); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%s\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", s, renderHTML(actual), renderHTML(expected))
+	}
+	bs, _ := MustCompileProgram("div p").MarshalBinary()
+	for _, bs := range [][]byte{nil, bs[:len(bs)-1], append([]byte{0}, bs[1:]...)} {
+		if err := (&Program{}).UnmarshalBinary(bs); err == nil {
+			t.Errorf("expected error for invalid program %v", bs)
+		}
+	}
+}
+
+func TestNFA(t *testing.T) {
+	for _, path := range htmlFiles() {
+		document, selectors := readHTML(path)
+		for _, selector := range selectors {
+			m, err := CompileNFA(selector)
+			if err != nil {
+				continue
+			}
+			s := MustCompile(selector)
+			for _, n := range append([]*html.Node{document}, All(MustCompile("body *"), document)...) {
+				if actual, expected := m.All(n), All(s, n); !reflect.DeepEqual(actual, expected) {
+					t.Errorf("%s: %s (from %s)\ngot:\n\t'%#v'\n\nexpected:\n\t'%#v'", path, selector, n.Data, renderHTML(actual), renderHTML(expected))
+				}
+			}
+		}
+	}
+	document, _ := html.Parse(strings.NewReader(`<div class="x"><p class="a"><b class="b"></b><i class="c"></i></p></div>`))
+	x, a, b, c := MustCompile(".x"), MustCompile(".a"), MustCompile(".b"), MustCompile(".c")
+	for _, s := range []Selector{
+		&DescendantSelector{Ancestor: a, Selector: &UnionSelector{SelectorA: &ChildSelector{Parent: x, Selector: b}, SelectorB: c}},
+		&DescendantSelector{Ancestor: x, Selector: &UnionSelector{SelectorA: &ChildSelector{Parent: a, Selector: b}, SelectorB: c}},
+		&ChildSelector{Parent: a, Selector: &DescendantSelector{Ancestor: x, Selector: b}},
+		&NextSiblingSelector{Sibling: b, Selector: &ChildSelector{Parent: a, Selector: c}},
+		&ChildSelector{Parent: &UnionSelector{SelectorA: x, SelectorB: a}, Selector: b},
+	} {
+		if actual, expected := NewNFA(s).All(document), All(s, document); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: got %v, expected %v", s, renderHTML(actual), renderHTML(expected))
+		}
+	}
+	selector := "div" + strings.Repeat(" *", 70)
+	if m := NewNFA(MustCompile(selector)); !m.fallback || m.All(document) != nil {
+		t.Errorf("expected fallback for %d compounds", 71)
+	}
+}
+
+func TestAllParallel(t *testing.T) {
+	for _, path := range htmlFiles() {
+		document, selectors := readHTML(path)
+		for _, selector := range selectors {
+			s, err := Compile(selector)
+			if err != nil {
+				continue
+			}
+			for _, workers := range []int{0, 1, 3} {
+				actual, err := AllParallel(context.Background(), s, document, workers)
+				if expected := All(s, document); err != nil || !reflect.DeepEqual(actual, expected) {
+					t.Errorf("%s: %s (%d workers)\ngot:\n\t'%#v' (%v)\n\nexpected:\n\t'%#v'", path, selector, workers, renderHTML(actual), err, renderHTML(expected))
+				}
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	document, _ := readHTML("testdata/benchmark.html")
+	if _, err := AllParallel(ctx, MustCompile("*"), document, 2); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(2)
+	s1, err1 := c.Compile("p > a")
+	s2, err2 := c.Compile("p > a")
+	if err1 != nil || err2 != nil || s1 != s2 {
+		t.Errorf("expected cached selector: %v %v %v %v", s1, err1, s2, err2)
+	}
+	if _, err := c.Compile("p >"); err == nil {
+		t.Errorf("expected error")
+	} else if _, err2 := c.Compile("p >"); err2 != err {
+		t.Errorf("expected cached error: %v %v", err, err2)
+	}
+	c.Compile("div")
+	if c.Compile("p > a"); c.Len() != 2 {
+		t.Errorf("expected cache to be bounded: %d", c.Len())
+	}
+	if stats := c.Stats(); stats != (CacheStats{Hits: 2, Misses: 4}) {
+		t.Errorf("bad stats: %#v", stats)
+	}
+	if _, err := c.Compile(":cached"); err == nil {
+		t.Errorf("expected error for unknown pseudo-class")
+	}
+	PseudoClasses["cached"] = func(*html.Node) bool { return true }
+	if _, err := c.Compile(":cached"); err != nil {
+		t.Errorf("expected recompilation after registering pseudo-class: %s", err)
+	}
+	element := func(name string) func(*html.Node) bool {
+		return func(n *html.Node) bool { return n.Data == name }
+	}
+	document, _ := html.Parse(strings.NewReader(`<p></p><div></div>`))
+	PseudoClasses["cached"] = element("p")
+	RegistryChanged()
+	if ns := All(c.MustCompile(":cached"), document); len(ns) != 1 || ns[0].Data != "p" {
+		t.Errorf("expected recompilation after replacing pseudo-class: %v", ns)
+	}
+	PseudoClasses["cached"] = element("div")
+	if ns := All(c.MustCompile(":cached"), document); len(ns) != 1 || ns[0].Data != "p" {
+		t.Errorf("expected cached selector until RegistryChanged: %v", ns)
+	}
+	RegistryChanged()
+	if ns := All(c.MustCompile(":cached"), document); len(ns) != 1 || ns[0].Data != "div" {
+		t.Errorf("expected recompilation after RegistryChanged: %v", ns)
+	}
+	delete(PseudoClasses, "cached")
+	if _, err := c.Compile(":cached"); err == nil {
+		t.Errorf("expected recompilation after removing pseudo-class")
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.MustCompile(fmt.Sprintf("p:nth-child(%d)", (i+j)%3))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("queries reuse pooled contexts - the race detector drops them")
+	}
+	document, _ := readHTML("testdata/benchmark.html")
+	for _, selector := range []string{"div", ".matched", "#fruits", "[class^=ma]", "ul li", "div > div.matched", ".article .body p span", "li + li ~ li", ".pear, .apple", "nope",
+		"li:first-child", "li:nth-child(odd)", "li:nth-last-of-type(2)", ":only-child", "ul > :last-child"} {
+		s := MustCompile(selector)
+		if allocs := testing.AllocsPerRun(10, func() { First(s, document) }); allocs != 0 {
+			t.Errorf("%s: First: expected 0 allocations, got %v", selector, allocs)
+		}
+		if allocs := testing.AllocsPerRun(10, func() { Count(s, document); Exists(s, document) }); allocs != 0 {
+			t.Errorf("%s: Count/Exists: expected 0 allocations, got %v", selector, allocs)
+		}
+		// only growing the result slice may allocate
+		n := len(All(s, document))
+		if count, exists := Count(s, document), Exists(s, document); count != n || exists != (n != 0) {
+			t.Errorf("%s: got Count %d and Exists %v for %d nodes", selector, count, exists, n)
+		}
+		if allocs := testing.AllocsPerRun(10, func() { All(s, document) }); allocs > float64(bits.Len(uint(n))+1) {
+			t.Errorf("%s: All: expected at most %d allocations, got %v", selector, bits.Len(uint(n))+1, allocs)
+		}
+	}
+	for _, identifier := range []string{"p", "foo-bar", "_a1"} {
+		escape := func() { Unescape(EscapeString(EscapeIdentifier(identifier))) }
+		if allocs := testing.AllocsPerRun(10, escape); allocs != 0 {
+			t.Errorf("%s: escape: expected 0 allocations, got %v", identifier, allocs)
+		}
+	}
+}
+
+func BenchmarkCache(b *testing.B) {
+	c := NewCache(16)
+	for i := 0; i < b.N; i++ {
+		c.MustCompile("p > a")
+	}
+}
+
 func BenchmarkNiklasFaschingCSS(b *testing.B) {
 	benchmark(b, func(selector string) func(*html.Node) []*html.Node {
 		s := MustCompile(selector)
@@ -74,6 +1075,12 @@ func BenchmarkNiklasFaschingCSS(b *testing.B) {
 	})
 }
 
+func BenchmarkNiklasFaschingCSSNFA(b *testing.B) {
+	benchmark(b, func(selector string) func(*html.Node) []*html.Node {
+		return MustCompileNFA(selector).All
+	})
+}
+
 func BenchmarkEricChiangCSS(b *testing.B) {
 	benchmark(b, func(selector string) func(*html.Node) []*html.Node {
 		s := css.MustCompile(selector)
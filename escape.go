@@ -3,63 +3,82 @@ package css
 
 import (
 	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-func EscapeIdentifier(unescaped string) (escaped string) {
+func EscapeIdentifier(unescaped string) string {
+	if isPlainIdentifier(unescaped) {
+		return unescaped
+	}
+	escaped := strings.Builder{}
+	escaped.Grow(len(unescaped) + 8)
 	for i := 0; i < len(unescaped); {
 		r, w := utf8.DecodeRuneInString(unescaped[i:])
 		switch {
 		case r == '\u0000':
-			escaped += string('\uFFFD')
+			escaped.WriteRune('\uFFFD')
 		case r >= '\u0001' && r <= '\u001F', r == '\u007F',
 			i == 0 && r >= '0' && r <= '9',
 			i == 1 && r >= '\u0030' && r <= '\u0039' && unescaped[0] == '\u002D':
-			escaped += `\` + strconv.FormatInt(int64(r), 16) + " "
+			escaped.WriteString(`\` + strconv.FormatInt(int64(r), 16) + " ")
 		case i == 0 && len(unescaped) == 1 && r == '-':
-			escaped += `\-`
+			escaped.WriteString(`\-`)
 		case r == '\u002D' || r == '\u005F' || r >= '\u0080' ||
 			r >= '\u0030' && r <= '\u0039' ||
 			r >= '\u0041' && r <= '\u005A' ||
 			r >= '\u0061' && r <= '\u007A':
-			escaped += string(r)
+			escaped.WriteRune(r)
 		default:
-			escaped += `\` + string(r)
+			escaped.WriteByte('\\')
+			escaped.WriteRune(r)
 		}
 		i += w
 	}
-	return escaped
+	return escaped.String()
 }
 
-func EscapeString(unescaped string) (escaped string) {
+func EscapeString(unescaped string) string {
+	if strings.IndexFunc(unescaped, needsStringEscape) == -1 && utf8.ValidString(unescaped) {
+		return unescaped
+	}
+	escaped := strings.Builder{}
+	escaped.Grow(len(unescaped) + 8)
 	for i := 0; i < len(unescaped); {
 		r, w := utf8.DecodeRuneInString(unescaped[i:])
 		switch {
 		case r == '\u0000':
-			escaped += string('\uFFFD')
+			escaped.WriteRune('\uFFFD')
 		case r >= '\u0001' && r <= '\u001F', r == '\u007F':
-			escaped += `\` + strconv.FormatInt(int64(r), 16) + " "
+			escaped.WriteString(`\` + strconv.FormatInt(int64(r), 16) + " ")
 		case r == '"' || r == '\\':
-			escaped += `\` + string(r)
+			escaped.WriteByte('\\')
+			escaped.WriteRune(r)
 		default:
-			escaped += string(r)
+			escaped.WriteRune(r)
 		}
 		i += w
 	}
-	return escaped
+	return escaped.String()
 }
 
-func Unescape(escaped string) (unescaped string) {
+func Unescape(escaped string) string {
+	if strings.IndexByte(escaped, '\\') == -1 && !strings.ContainsRune(escaped, '\uFFFD') && utf8.ValidString(escaped) {
+		return escaped
+	}
+	unescaped := strings.Builder{}
+	unescaped.Grow(len(escaped))
 	for i := 0; i < len(escaped); {
 		r, w := utf8.DecodeRuneInString(escaped[i:])
 		i += w
 		switch {
 		case r == '\uFFFD':
-			unescaped += string('\u0000')
+			unescaped.WriteRune('\u0000')
 		case r == '\\' && i < len(escaped) && !isHexDigit(rune(escaped[i])):
-			unescaped += string(escaped[i])
-			i++
+			r, w := utf8.DecodeRuneInString(escaped[i:])
+			unescaped.WriteRune(r)
+			i += w
 		case r == '\\' && i < len(escaped):
 			j := i
 			for ; j < i+6 && j < len(escaped) && isHexDigit(rune(escaped[j])); j++ {
@@ -68,13 +87,32 @@ func Unescape(escaped string) (unescaped string) {
 			if err != nil {
 				panic(err)
 			}
-			unescaped, i = unescaped+string(r), j
-			if i < len(escaped) && unicode.IsSpace(rune(escaped[i])) {
+			unescaped.WriteString(string(rune(r)))
+			if i = j; i < len(escaped) && unicode.IsSpace(rune(escaped[i])) {
 				i++
 			}
 		default:
-			unescaped += string(r)
+			unescaped.WriteRune(r)
+		}
+	}
+	return unescaped.String()
+}
+
+// isPlainIdentifier checks whether s is an identifier that does not need escaping.
+func isPlainIdentifier(s string) bool {
+	if s == "" {
+		return true
+	} else if s == "-" || isDigit(rune(s[0])) || len(s) > 1 && s[0] == '-' && isDigit(rune(s[1])) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < utf8.RuneSelf && !isNameChar(rune(c)) || c == '\\' {
+			return false
 		}
 	}
-	return unescaped
+	return utf8.ValidString(s)
+}
+
+func needsStringEscape(r rune) bool {
+	return r <= '\u001F' || r == '\u007F' || r == '"' || r == '\\'
 }
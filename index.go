@@ -0,0 +1,140 @@
+package css
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Index is a reusable index of a document for repeated queries.
+// Queries seed their candidates from the id, class or element of the rightmost compound selector
+// rather than visiting every node of the document.
+// The index does not notice mutations of the underlying tree - call Invalidate after changing it.
+// Like All, it does not contain template contents and the elements of declarative shadow roots - parts holds
+// the ones ::part exposes.
+type Index struct {
+	root      *html.Node
+	elements  []*html.Node
+	parts     []*html.Node
+	order     map[*html.Node]int
+	positions map[*html.Node]position
+	ids       map[string][]*html.Node
+	classes   map[string][]*html.Node
+	tags      map[string][]*html.Node
+}
+
+func NewIndex(root *html.Node) *Index {
+	i := &Index{root: root}
+	i.Invalidate()
+	return i
+}
+
+// Invalidate rebuilds the index from the current state of the tree.
+func (i *Index) Invalidate() {
+	i.elements, i.parts = nil, nil
+	i.order = map[*html.Node]int{}
+	i.positions = map[*html.Node]position{}
+	i.ids = map[string][]*html.Node{}
+	i.classes = map[string][]*html.Node{}
+	i.tags = map[string][]*html.Node{}
+	if isElementNode(i.root) {
+		i.add(i.root)
+	}
+	i.build(i.root)
+}
+
+func (i *Index) First(s Selector) *html.Node {
+	if ns := i.all(s, true); len(ns) != 0 {
+		return ns[0]
+	}
+	return nil
+}
+
+func (i *Index) All(s Selector) []*html.Node {
+	return i.all(s, false)
+}
+
+func (i *Index) all(s Selector, first bool) []*html.Node {
+	branches, c := unionBranches(s, nil), &MatchContext{index: i}
+	var ns []*html.Node
+	for _, s := range branches {
+		for _, n := range i.candidates(s) {
+			if matchWith(c, s, n) {
+				ns = append(ns, n)
+				if first && len(branches) == 1 {
+					return ns
+				}
+			}
+		}
+	}
+	if len(branches) == 1 {
+		return ns
+	}
+	sort.Slice(ns, func(a, b int) bool { return i.order[ns[a]] < i.order[ns[b]] })
+	j := 0
+	for k := range ns {
+		if k == 0 || ns[k] != ns[j-1] {
+			ns[j] = ns[k]
+			j++
+		}
+	}
+	return ns[:j]
+}
+
+func (i *Index) candidates(s Selector) []*html.Node {
+	if isPart(s) {
+		return i.parts
+	}
+	switch id, class, element := subjectKey(s); {
+	case id != "":
+		return i.ids[id]
+	case class != "":
+		return i.classes[class]
+	case element != "":
+		return i.tags[element]
+	default:
+		return i.elements
+	}
+}
+
+func (i *Index) build(n *html.Node) {
+	if !defaultQuery.descends(n) {
+		return
+	}
+	childPositions(n, i.positions, nil)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !defaultQuery.enters(c) {
+			defaultQuery.visitShadowTree(c, func(n *html.Node) bool {
+				i.order[n], i.parts = len(i.order), append(i.parts, n)
+				return true
+			})
+			continue
+		} else if c.Type == html.ElementNode {
+			i.add(c)
+		}
+		i.build(c)
+	}
+}
+
+func (i *Index) add(n *html.Node) {
+	i.order[n] = len(i.order)
+	i.elements = append(i.elements, n)
+	i.tags[n.Data] = append(i.tags[n.Data], n)
+	for _, a := range n.Attr {
+		if a.Key == "id" {
+			i.ids[a.Val] = append(i.ids[a.Val], n)
+			break
+		}
+	}
+	for _, a := range n.Attr {
+		if a.Key == "class" {
+			for _, class := range strings.FieldsFunc(a.Val, isWhitespace) {
+				if ns := i.classes[class]; len(ns) == 0 || ns[len(ns)-1] != n {
+					i.classes[class] = append(ns, n)
+				}
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package css
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SelectorJSON wraps a Selector for encoding as versioned json with type tags, e.g.
+//
+//	{"version": 1, "selector": {"type": "sequence", "selectors": [{"type": "element", "element": "li"}]}}
+//
+// Unmarshaling rebuilds a working Selector bound to the current Matchers and pseudo-classes.
+// Combinators are encoded with their two operands in selectors, e.g. [ancestor, selector] - pseudo-elements
+// with their originating selector. Pseudo-functions and pseudo-elements are encoded with both their raw args
+// and their typed argument, e.g. {"type": "nth", "a": 2, "b": 1} for :nth-child(2n+1). Unmarshaling compiles
+// the args - the argument is only used if they are missing.
+type SelectorJSON struct {
+	Selector Selector
+}
+
+const selectorJSONVersion = 1
+
+type selectorJSON struct {
+	Version  int       `json:"version"`
+	Selector *jsonNode `json:"selector"`
+}
+
+type jsonNode struct {
+	Type      string        `json:"type"`
+	Element   string        `json:"element,omitempty"`
+	Key       string        `json:"key,omitempty"`
+	Value     string        `json:"value,omitempty"`
+	Matcher   string        `json:"matcher,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Args      string        `json:"args,omitempty"`
+	Argument  *jsonArgument `json:"argument,omitempty"`
+	Selectors []*jsonNode   `json:"selectors,omitempty"`
+}
+
+// jsonArgument is the typed Argument of a pseudo-function or pseudo-element. Relative selectors are encoded
+// as selectors with their combinators at the same index.
+type jsonArgument struct {
+	Type        string      `json:"type"`
+	A           int         `json:"a,omitempty"`
+	B           int         `json:"b,omitempty"`
+	Value       string      `json:"value,omitempty"`
+	Number      float64     `json:"number,omitempty"`
+	Identifiers []string    `json:"identifiers,omitempty"`
+	Combinators []string    `json:"combinators,omitempty"`
+	Selectors   []*jsonNode `json:"selectors,omitempty"`
+}
+
+func (j SelectorJSON) MarshalJSON() ([]byte, error) {
+	n, err := encodeJSON(j.Selector)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(selectorJSON{selectorJSONVersion, n})
+}
+
+func (j *SelectorJSON) UnmarshalJSON(bs []byte) error {
+	v := selectorJSON{}
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return err
+	} else if v.Version != selectorJSONVersion {
+		return fmt.Errorf("unsupported selector json version: %d", v.Version)
+	}
+	s, err := decodeJSON(v.Selector)
+	if err != nil {
+		return err
+	}
+	j.Selector = s
+	return nil
+}
+
+func encodeJSON(s Selector) (*jsonNode, error) {
+	switch s := s.(type) {
+	case *UniversalSelector:
+		return &jsonNode{Type: "universal"}, nil
+	case *ElementSelector:
+		return &jsonNode{Type: "element", Element: s.Element}, nil
+	case *IDSelector:
+		return &jsonNode{Type: "id", Value: s.Value}, nil
+	case *ClassSelector:
+		return &jsonNode{Type: "class", Value: s.Value}, nil
+	case *AttributeSelector:
+		return &jsonNode{Type: "attribute", Key: s.Key, Value: s.Value, Matcher: s.Type}, nil
+	case *PseudoSelector:
+		return &jsonNode{Type: "pseudo", Name: s.Name}, nil
+	case *PseudoFunctionSelector:
+		a, err := encodeJSONArgument(s.Argument)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Type: "pseudo-function", Name: s.Name, Args: s.Args, Argument: a}, nil
+	case *PseudoElementSelector:
+		n, err := encodeJSONNodes("pseudo-element", s.Selector)
+		if err != nil {
+			return nil, err
+		}
+		n.Name, n.Args = s.Name, s.Args
+		n.Argument, err = encodeJSONArgument(s.Argument)
+		return n, err
+	case *SelectorSequence:
+		return encodeJSONNodes("sequence", s.Selectors...)
+	case *DescendantSelector:
+		return encodeJSONNodes("descendant", s.Ancestor, s.Selector)
+	case *ChildSelector:
+		return encodeJSONNodes("child", s.Parent, s.Selector)
+	case *NextSiblingSelector:
+		return encodeJSONNodes("next-sibling", s.Sibling, s.Selector)
+	case *SubsequentSiblingSelector:
+		return encodeJSONNodes("subsequent-sibling", s.Sibling, s.Selector)
+	case *UnionSelector:
+		return encodeJSONNodes("union", s.SelectorA, s.SelectorB)
+	default:
+		return nil, fmt.Errorf("cannot encode selector of type %T", s)
+	}
+}
+
+func encodeJSONNodes(kind string, ss ...Selector) (*jsonNode, error) {
+	n := &jsonNode{Type: kind, Selectors: make([]*jsonNode, len(ss))}
+	for i, s := range ss {
+		c, err := encodeJSON(s)
+		if err != nil {
+			return nil, err
+		}
+		n.Selectors[i] = c
+	}
+	return n, nil
+}
+
+// encodeJSONArgument encodes the typed argument of a pseudo-function - nil for legacy PseudoFunctions.
+func encodeJSONArgument(a Argument) (*jsonArgument, error) {
+	switch a := a.(type) {
+	case nil:
+		return nil, nil
+	case *SelectorArgument:
+		n, err := encodeJSON(a.Selector)
+		return &jsonArgument{Type: "selector-list", Selectors: []*jsonNode{n}}, err
+	case *RelativeSelectorArgument:
+		j := &jsonArgument{Type: "relative-selector-list"}
+		for _, r := range a.Selectors {
+			n, err := encodeJSON(r.Selector)
+			if err != nil {
+				return nil, err
+			}
+			j.Combinators, j.Selectors = append(j.Combinators, r.Combinator), append(j.Selectors, n)
+		}
+		return j, nil
+	case *NthArgument:
+		return &jsonArgument{Type: "nth", A: a.A, B: a.B}, nil
+	case *StringArgument:
+		return &jsonArgument{Type: "string", Value: a.Value}, nil
+	case *NumberArgument:
+		return &jsonArgument{Type: "number", Number: a.Value}, nil
+	case *IdentifierArgument:
+		return &jsonArgument{Type: "identifier", Identifiers: a.Identifiers}, nil
+	default:
+		return nil, fmt.Errorf("cannot encode argument of type %T", a)
+	}
+}
+
+func decodeJSONArgument(j *jsonArgument) (Argument, error) {
+	ss := make([]Selector, len(j.Selectors))
+	for i, n := range j.Selectors {
+		s, err := decodeJSON(n)
+		if err != nil {
+			return nil, err
+		}
+		ss[i] = s
+	}
+	switch j.Type {
+	case "selector-list":
+		if len(ss) != 1 {
+			return nil, fmt.Errorf("invalid selector json: selector-list requires 1 selector, got %d", len(ss))
+		}
+		return &SelectorArgument{ss[0]}, nil
+	case "relative-selector-list":
+		if len(ss) == 0 || len(ss) != len(j.Combinators) {
+			return nil, fmt.Errorf("invalid selector json: relative-selector-list requires a combinator for each selector")
+		}
+		a := &RelativeSelectorArgument{}
+		for i, s := range ss {
+			a.Selectors = append(a.Selectors, RelativeSelector{j.Combinators[i], s})
+		}
+		return a, nil
+	case "nth":
+		return &NthArgument{j.A, j.B}, nil
+	case "string":
+		return &StringArgument{j.Value}, nil
+	case "number":
+		return &NumberArgument{j.Number}, nil
+	case "identifier":
+		return &IdentifierArgument{j.Identifiers}, nil
+	default:
+		return nil, fmt.Errorf("invalid selector json: unknown argument type %q", j.Type)
+	}
+}
+
+// args returns the args of a pseudo-function or pseudo-element node - or those of its typed argument.
+func (n *jsonNode) args() (string, error) {
+	if n.Args != "" || n.Argument == nil {
+		return n.Args, nil
+	}
+	a, err := decodeJSONArgument(n.Argument)
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
+
+func decodeJSON(n *jsonNode) (Selector, error) {
+	if n == nil {
+		return nil, errors.New("invalid selector json: missing selector")
+	}
+	ss := make([]Selector, len(n.Selectors))
+	for i, c := range n.Selectors {
+		s, err := decodeJSON(c)
+		if err != nil {
+			return nil, err
+		}
+		ss[i] = s
+	}
+	if combinator := jsonCombinators[n.Type]; combinator != "" {
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("invalid selector json: %s requires 2 selectors, got %d", n.Type, len(ss))
+		}
+		if Combinators[combinator] == nil {
+			return nil, fmt.Errorf("invalid selector json: unknown combinator %q", combinator)
+		}
+		return Combinators[combinator](ss[0], ss[1]), nil
+	}
+	switch n.Type {
+	case "universal":
+		return &UniversalSelector{"*"}, nil
+	case "element":
+		return elementSelector(n.Element), nil
+	case "id":
+		return &IDSelector{attributeSelector("id", n.Value, "=")}, nil
+	case "class":
+		return &ClassSelector{attributeSelector("class", n.Value, "~=")}, nil
+	case "attribute":
+		if Matchers[n.Matcher] == nil {
+			return nil, fmt.Errorf("invalid selector json: unknown matcher %q", n.Matcher)
+		}
+		return attributeSelector(n.Key, n.Value, n.Matcher), nil
+	case "pseudo":
+		match := pseudoClass(n.Name)
+		if match == nil {
+			return nil, errors.New("invalid pseudo selector: :" + n.Name)
+		}
+		return &PseudoSelector{Name: n.Name, match: match}, nil
+	case "pseudo-function":
+		f := pseudoFunction(n.Name)
+		if f == nil {
+			return nil, errors.New("invalid pseudo function: :" + n.Name)
+		}
+		args, err := n.args()
+		if err != nil {
+			return nil, err
+		}
+		argument, match, err := f(args, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &PseudoFunctionSelector{Name: n.Name, Args: args, Argument: argument, match: match}, nil
+	case "pseudo-element":
+		f := pseudoElement(n.Name)
+		if f == nil {
+			return nil, errors.New("invalid pseudo element: ::" + n.Name)
+		} else if len(ss) != 1 {
+			return nil, fmt.Errorf("invalid selector json: pseudo-element requires 1 selector, got %d", len(ss))
+		}
+		args, err := n.args()
+		if err != nil {
+			return nil, err
+		}
+		argument, match, err := f(args, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &PseudoElementSelector{Selector: ss[0], Name: n.Name, Args: args, Argument: argument, match: match}, nil
+	case "sequence":
+		if len(ss) == 0 {
+			return nil, errors.New("invalid selector json: empty sequence")
+		}
+		for _, s := range ss {
+			if !isSimpleSelector(s) {
+				return nil, fmt.Errorf("invalid selector json: sequence contains %s", s)
+			}
+		}
+		return &SelectorSequence{Selectors: ss}, nil
+	default:
+		return nil, fmt.Errorf("invalid selector json: unknown type %q", n.Type)
+	}
+}
+
+func isSimpleSelector(s Selector) bool {
+	switch s.(type) {
+	case *UniversalSelector, *ElementSelector, *IDSelector, *ClassSelector, *AttributeSelector, *PseudoSelector, *PseudoFunctionSelector:
+		return true
+	}
+	return false
+}
+
+var jsonCombinators = map[string]string{
+	"descendant":         " ",
+	"child":              ">",
+	"next-sibling":       "+",
+	"subsequent-sibling": "~",
+	"union":              ",",
+}
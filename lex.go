@@ -6,7 +6,10 @@ package css
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
 )
@@ -15,6 +18,7 @@ type token struct {
 	category tokenCategory
 	string   string
 	index    int
+	end      int
 }
 
 type tokenCategory int
@@ -34,6 +38,7 @@ const (
 	tokenCombinator
 	tokenBracketOpen
 	tokenBracketClose
+	tokenPseudoElement
 )
 
 const eof = -1
@@ -41,19 +46,48 @@ const eof = -1
 type stateFn func(*lexer) stateFn
 
 type lexer struct {
-	input  string
-	index  int
-	start  int
-	width  int
-	tokens []token
-	error  error
+	input    string
+	index    int
+	start    int
+	width    int
+	tokens   []token
+	error    error
+	brackets bool
+	keys     *tokenKeys
+}
+
+// tokenKeys contains the Combinators and Matchers keys sorted by length - longest first. Keys of the same
+// length are ordered by category: combinators first outside of brackets, matchers first inside of them.
+type tokenKeys struct {
+	version           registryVersion
+	outside, brackets []tokenKey
+}
+
+type tokenKey struct {
+	key      string
+	category tokenCategory
 }
 
-func lex(input string) ([]token, error) {
-	l := &lexer{input: strings.TrimSpace(input)}
+// registeredKeys holds the *tokenKeys of the current registryVersion.
+var registeredKeys atomic.Value
+
+var lexers = sync.Pool{New: func() interface{} { return &lexer{} }}
+
+// lex tokenizes input. Lexers are pooled to reuse their token buffers -
+// the returned lexer must be released once its tokens have been consumed.
+func lex(input string) (*lexer, error) {
+	l := lexers.Get().(*lexer)
+	// leading whitespace is skipped rather than trimmed to keep token indexes relative to input
+	input = strings.TrimRightFunc(input, unicode.IsSpace)
+	start := len(input) - len(strings.TrimLeftFunc(input, unicode.IsSpace))
+	*l = lexer{input: input, index: start, start: start, tokens: l.tokens[:0], keys: currentTokenKeys()}
 	for state := lexSpace; state != nil; state = state(l) {
 	}
-	return l.tokens, l.error
+	return l, l.error
+}
+
+func (l *lexer) release() {
+	lexers.Put(l)
 }
 
 func (l *lexer) next() rune {
@@ -82,9 +116,9 @@ func (l *lexer) backup() {
 func (l *lexer) emit(c tokenCategory) {
 	switch c {
 	case tokenClass, tokenIdent, tokenID, tokenPseudoClass, tokenPseudoFunction, tokenString:
-		l.tokens = append(l.tokens, token{c, Unescape(l.input[l.start:l.index]), l.start})
+		l.tokens = append(l.tokens, token{c, Unescape(l.input[l.start:l.index]), l.start, l.index})
 	default:
-		l.tokens = append(l.tokens, token{c, l.input[l.start:l.index], l.start})
+		l.tokens = append(l.tokens, token{c, l.input[l.start:l.index], l.start, l.index})
 	}
 	l.start = l.index
 }
@@ -109,21 +143,18 @@ func lexSpace(l *lexer) stateFn {
 		l.acceptRun(isWhitespace)
 		l.emit(tokenSpace)
 	}
-	switch r := l.next(); {
-	case isMatchChar(r) && l.peek() == '=':
-		l.next()
-		l.emit(tokenMatcher)
-		return lexSpace
-	case r == '=':
-		l.emit(tokenMatcher)
-		return lexSpace
-	case isCombinatorChar(r):
-		l.emit(tokenCombinator)
+	if c, n := l.registeredToken(); n != 0 {
+		l.index += n
+		l.emit(c)
 		return lexSpace
+	}
+	switch r := l.next(); {
 	case r == '[':
+		l.brackets = true
 		l.emit(tokenBracketOpen)
 		return lexSpace
 	case r == ']':
+		l.brackets = false
 		l.emit(tokenBracketClose)
 		return lexSpace
 	case r == '(':
@@ -170,10 +201,61 @@ func isHexDigit(r rune) bool {
 	return 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F' || '0' <= r && r <= '9'
 }
 
-func isWhitespace(r rune) bool     { return strings.ContainsRune(" \t\f\r\n", r) }
-func isDigit(r rune) bool          { return '0' <= r && r <= '9' }
-func isMatchChar(r rune) bool      { return Matchers[string(r)+"="] != nil }
-func isCombinatorChar(r rune) bool { return Combinators[string(r)] != nil }
+func isWhitespace(r rune) bool { return strings.ContainsRune(" \t\f\r\n", r) }
+func isDigit(r rune) bool      { return '0' <= r && r <= '9' }
+
+// registeredToken returns the category and length of the longest Combinators or Matchers key at the current position.
+// Keys of both are accepted anywhere - if both match with the same length, matchers win inside of brackets.
+// Keys ending in a name char only match if they are not followed by another name char, e.g. a combinator "in"
+// does not match the start of "input".
+func (l *lexer) registeredToken() (tokenCategory, int) {
+	input, keys := l.input[l.index:], l.keys.outside
+	if l.brackets {
+		keys = l.keys.brackets
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(input, k.key) {
+			continue
+		}
+		last, _ := utf8.DecodeLastRuneInString(k.key)
+		if next, _ := utf8.DecodeRuneInString(input[len(k.key):]); isNameChar(last) && isNameChar(next) {
+			continue
+		}
+		return k.category, len(k.key)
+	}
+	return tokenEOF, 0
+}
+
+// currentTokenKeys returns the sorted keys of Combinators and Matchers - they are only sorted again after keys
+// have been added or removed (see RegistryChanged).
+func currentTokenKeys() *tokenKeys {
+	version := currentRegistryVersion()
+	if keys, ok := registeredKeys.Load().(*tokenKeys); ok && keys.version == version {
+		return keys
+	}
+	keys := &tokenKeys{version: version}
+	for k := range Combinators {
+		if strings.TrimSpace(k) != "" {
+			keys.outside = append(keys.outside, tokenKey{k, tokenCombinator})
+		}
+	}
+	for k := range Matchers {
+		if k != "" {
+			keys.outside = append(keys.outside, tokenKey{k, tokenMatcher})
+		}
+	}
+	keys.brackets = append([]tokenKey{}, keys.outside...)
+	sort.SliceStable(keys.outside, func(i, j int) bool {
+		ki, kj := keys.outside[i], keys.outside[j]
+		return len(ki.key) > len(kj.key) || len(ki.key) == len(kj.key) && ki.category == tokenCombinator && kj.category != tokenCombinator
+	})
+	sort.SliceStable(keys.brackets, func(i, j int) bool {
+		ki, kj := keys.brackets[i], keys.brackets[j]
+		return len(ki.key) > len(kj.key) || len(ki.key) == len(kj.key) && ki.category == tokenMatcher && kj.category != tokenMatcher
+	})
+	registeredKeys.Store(keys)
+	return keys
+}
 
 func acceptNameChars(l *lexer) {
 	for {
@@ -253,14 +335,18 @@ func lexID(l *lexer) stateFn {
 }
 
 func lexPseudo(l *lexer) stateFn {
-	if l.peek() == ':' {
-		return l.errorf("invalid use of pseudo element")
+	element := l.peek() == ':'
+	if element {
+		l.next()
+		l.ignore()
 	}
 	err := acceptIdentifier(l)
 	if err != nil {
 		return l.errorf("%s", err)
 	}
-	if l.peek() == '(' {
+	if element {
+		l.emit(tokenPseudoElement)
+	} else if l.peek() == '(' {
 		l.emit(tokenPseudoFunction)
 	} else {
 		l.emit(tokenPseudoClass)
@@ -284,8 +370,8 @@ func lexFunctionArguments(l *lexer) stateFn {
 	if l.next() != '(' {
 		return l.errorf("invalid start of function arguments")
 	}
-	for r, lvl := l.next(), 1; lvl != 0; r = l.next() {
-		switch r {
+	for lvl := 1; lvl != 0; {
+		switch l.next() {
 		case eof:
 			return l.errorf("unterminated function arguments")
 		case '(':
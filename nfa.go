@@ -0,0 +1,179 @@
+package css
+
+import (
+	"golang.org/x/net/html"
+)
+
+// NFA matches a selector top-down in a single traversal of the document rather than right to left from each node.
+// Each compound selector is a state. A node is in a state if it matches its compound and its combinator is
+// satisfied by the states of the ancestors, parent, previous sibling or preceding siblings of the node.
+// These are carried along during the traversal, which makes All linear in the size of the document
+// no matter how many ancestor chains the right-to-left Match would have to revisit.
+// Selectors with more than 64 compounds, ::part or combinators with a non-compound right side fall back to the regular All.
+// Like All, the traversal does not descend into template contents and declarative shadow roots.
+type NFA struct {
+	selector Selector
+	states   []nfaState
+	final    uint64
+	context  bool
+	fallback bool
+}
+
+type nfaState struct {
+	compound Selector
+	start    bool
+	// edges contains the states required of the relatives of a node for each combinator.
+	edges [4]uint64
+}
+
+const (
+	edgeDescendant = iota
+	edgeChild
+	edgeNextSibling
+	edgeSubsequentSibling
+)
+
+// relatives holds the combined states of the relatives of a node.
+type relatives struct {
+	ancestors, parent, previous, preceding uint64
+}
+
+func CompileNFA(selector string) (*NFA, error) {
+	s, err := Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+	return NewNFA(s), nil
+}
+
+func MustCompileNFA(selector string) *NFA {
+	m, err := CompileNFA(selector)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func NewNFA(s Selector) *NFA {
+	m := &NFA{selector: s, context: needsContext(s)}
+	final, ok := m.build(s)
+	m.final, m.fallback = final, !ok || partBranches(s) != nil
+	return m
+}
+
+func (m *NFA) String() string { return m.selector.String() }
+
+func (m *NFA) All(n *html.Node) []*html.Node {
+	if m.fallback {
+		return All(m.selector, n)
+	}
+	var c *MatchContext
+	if m.context {
+		c = &MatchContext{}
+	}
+	ns, _ := m.all(c, n, m.relatives(c, n), nil)
+	return ns
+}
+
+// build adds the states of s and returns its final states.
+func (m *NFA) build(s Selector) (uint64, bool) {
+	switch s := s.(type) {
+	case *UnionSelector:
+		a, ok := m.build(s.SelectorA)
+		b, ok2 := m.build(s.SelectorB)
+		return a | b, ok && ok2
+	case *DescendantSelector:
+		return m.connect(s.Ancestor, s.Selector, edgeDescendant)
+	case *ChildSelector:
+		return m.connect(s.Parent, s.Selector, edgeChild)
+	case *NextSiblingSelector:
+		return m.connect(s.Sibling, s.Selector, edgeNextSibling)
+	case *SubsequentSiblingSelector:
+		return m.connect(s.Sibling, s.Selector, edgeSubsequentSibling)
+	default:
+		if len(m.states) == 64 {
+			return 0, false
+		}
+		m.states = append(m.states, nfaState{compound: s, start: true})
+		return 1 << (len(m.states) - 1), true
+	}
+}
+
+// connect builds left and right and makes the start states of right require the final states of left via the given edge.
+// The edge applies to the node matched by right - so right has to be a compound selector. The parser only
+// creates those but combinators constructed by hand can have any selector on the right.
+func (m *NFA) connect(left, right Selector, edge int) (uint64, bool) {
+	switch right.(type) {
+	case *UnionSelector, *DescendantSelector, *ChildSelector, *NextSiblingSelector, *SubsequentSiblingSelector:
+		return 0, false
+	}
+	from, ok := m.build(left)
+	i := len(m.states)
+	final, ok2 := m.build(right)
+	for ; i < len(m.states); i++ {
+		if s := &m.states[i]; s.start {
+			s.start, s.edges[edge] = false, from
+		}
+	}
+	return final, ok && ok2
+}
+
+func (m *NFA) all(c *MatchContext, n *html.Node, r relatives, ns []*html.Node) ([]*html.Node, uint64) {
+	states := m.match(c, n, r)
+	if states&m.final != 0 {
+		ns = append(ns, n)
+	}
+	if !defaultQuery.descends(n) {
+		return ns, states
+	}
+	children := relatives{ancestors: r.ancestors | states, parent: states}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		var childStates uint64
+		if defaultQuery.enters(child) {
+			ns, childStates = m.all(c, child, children, ns)
+		} else {
+			// shadow roots are still siblings of the light tree
+			childStates = m.match(c, child, children)
+		}
+		children.next(child, childStates)
+	}
+	return ns, states
+}
+
+// relatives computes the relatives of n by matching its ancestors and their preceding siblings.
+func (m *NFA) relatives(c *MatchContext, n *html.Node) relatives {
+	if n.Parent == nil {
+		return relatives{}
+	}
+	pr := m.relatives(c, n.Parent)
+	states := m.match(c, n.Parent, pr)
+	r := relatives{ancestors: pr.ancestors | states, parent: states}
+	for s := n.Parent.FirstChild; s != n; s = s.NextSibling {
+		r.next(s, m.match(c, s, r))
+	}
+	return r
+}
+
+func (m *NFA) match(c *MatchContext, n *html.Node, r relatives) (states uint64) {
+	if n.Type != html.ElementNode {
+		return 0
+	}
+	for i, s := range m.states {
+		if (s.start || s.edges[edgeDescendant]&r.ancestors != 0 || s.edges[edgeChild]&r.parent != 0 ||
+			s.edges[edgeNextSibling]&r.previous != 0 || s.edges[edgeSubsequentSibling]&r.preceding != 0) &&
+			matchWith(c, s.compound, n) {
+			states |= 1 << i
+		}
+	}
+	return states
+}
+
+// next moves r on from the sibling n with the given states to its next sibling.
+// Like NextSiblingSelector, only an element directly preceding a node counts as its previous sibling.
+func (r *relatives) next(n *html.Node, states uint64) {
+	if n.Type != html.ElementNode {
+		r.previous = 0
+		return
+	}
+	r.previous, r.preceding = states, r.preceding|states
+}
@@ -0,0 +1,92 @@
+package css
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+// task is either a single node or a whole subtree of the document.
+// parts marks shadow roots the query does not enter - only their ::part elements are matched.
+type task struct {
+	n              *html.Node
+	subtree, parts bool
+}
+
+// AllParallel is like All but partitions the tree into subtrees that are matched by workers concurrently.
+// The results are merged back into document order. A workers value < 1 defaults to GOMAXPROCS.
+// The tree must not be mutated while the query is running.
+func AllParallel(ctx context.Context, s Selector, n *html.Node, workers int) ([]*html.Node, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	q := newQuery(s)
+	defer q.release()
+	tasks := partition(n, workers*16, &q)
+	results := make([][]*html.Node, len(tasks))
+	indices := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(q query) {
+			defer wg.Done()
+			q.context = &MatchContext{}
+			for i := range indices {
+				if t, f := tasks[i], q.filter(tasks[i].n); t.parts {
+					q.walkParts(t.n, func(n *html.Node) bool { results[i] = append(results[i], n); return true })
+				} else if t.subtree {
+					results[i] = q.all(t.n, f, nil)
+				} else if q.match(t.n, &f) {
+					results[i] = []*html.Node{t.n}
+				}
+			}
+		}(q)
+	}
+loop:
+	for i := range tasks {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(indices)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var ns []*html.Node
+	for _, result := range results {
+		ns = append(ns, result...)
+	}
+	return ns, nil
+}
+
+// partition splits the tree rooted at n into at least min tasks (if possible) - in document order.
+// Subtrees are expanded level by level into their root node followed by the subtrees of the children it enters.
+func partition(n *html.Node, min int, q *query) []task {
+	tasks := []task{{n, true, false}}
+	for expanded := true; expanded && len(tasks) < min; {
+		expanded = false
+		next := make([]task, 0, len(tasks))
+		for _, t := range tasks {
+			if !t.subtree || t.parts || t.n.FirstChild == nil || !q.descends(t.n) {
+				next = append(next, t)
+				continue
+			}
+			expanded = true
+			next = append(next, task{t.n, false, false})
+			for c := t.n.FirstChild; c != nil; c = c.NextSibling {
+				if q.enters(c) {
+					next = append(next, task{c, true, false})
+				} else if q.parts != nil {
+					next = append(next, task{c, true, true})
+				}
+			}
+		}
+		tasks = next
+	}
+	return tasks
+}
@@ -4,11 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	"golang.org/x/net/html"
 )
 
 type parser struct {
 	tokens []token
 	index  int
+	// spans records the spans of the parsed nodes - nil if they are not needed. offset is the position of
+	// the tokens in the selector string, e.g. of the arguments of :not(...).
+	spans  *Spans
+	offset int
+	// element is the pseudo-element of the last simple selector sequence - its originating selector is
+	// everything before it and only known once that has been parsed.
+	element *PseudoElementSelector
 }
 
 func (p *parser) next() token {
@@ -33,20 +42,35 @@ func (p *parser) backup() {
 	p.index--
 }
 
+// span returns the span from start to the end of the last consumed token.
+func (p *parser) span(start int) Span {
+	if p.index == 0 {
+		return p.spanAt(start, start)
+	}
+	return p.spanAt(start, p.tokens[p.index-1].end)
+}
+
+// spanAt returns the span of the token positions start and end in the selector string.
+func (p *parser) spanAt(start, end int) Span {
+	return Span{p.offset + start, p.offset + end}
+}
+
 func (p *parser) acceptRun(c tokenCategory) {
 	for p.next().category == c {
 	}
 	p.backup()
 }
 
-func parse(tokens []token) (Selector, error) {
-	p := &parser{tokens: tokens}
+func parse(tokens []token, spans *Spans, offset int) (Selector, error) {
+	p := &parser{tokens: tokens, spans: spans, offset: offset}
 	s, err := p.parseSimpleSelectorSequence()
 	if err != nil {
 		return nil, err
 	}
 	for {
-		if p.peek().category == tokenEOF {
+		if s, err = p.applyPseudoElement(s); err != nil {
+			return nil, err
+		} else if p.peek().category == tokenEOF {
 			return s, nil
 		}
 		s, err = p.parseComplexSelectorSequence(s)
@@ -58,22 +82,26 @@ func parse(tokens []token) (Selector, error) {
 
 func (p *parser) parseSimpleSelectorSequence() (Selector, error) {
 	s := SelectorSequence{}
-	switch p.peek().category {
+	switch t := p.peek(); t.category {
 	case tokenIdent:
-		element := strings.ToLower(p.next().string)
-		s.Selectors = append(s.Selectors, &ElementSelector{element})
+		s.Selectors = append(s.Selectors, elementSelector(strings.ToLower(p.next().string)))
+		p.spans.add(s.Selectors[0], p.span(t.index))
 	case tokenUniversal:
 		s.Selectors = append(s.Selectors, &UniversalSelector{p.next().string})
+		p.spans.add(s.Selectors[0], p.span(t.index))
 	}
 loop:
 	for {
-		switch p.peek().category {
+		// the . # and : prefixes are not part of the tokens
+		switch t := p.peek(); t.category {
 		case tokenClass:
-			class := strings.ToLower(p.next().string)
-			s.Selectors = append(s.Selectors, &ClassSelector{attributeSelector("class", class, "~=")})
+			cs := &ClassSelector{attributeSelector("class", strings.ToLower(p.next().string), "~=")}
+			p.spans.add(cs, p.span(t.index-1))
+			s.Selectors = append(s.Selectors, cs)
 		case tokenID:
-			id := strings.ToLower(p.next().string)
-			s.Selectors = append(s.Selectors, &IDSelector{attributeSelector("id", id, "=")})
+			is := &IDSelector{attributeSelector("id", strings.ToLower(p.next().string), "=")}
+			p.spans.add(is, p.span(t.index-1))
+			s.Selectors = append(s.Selectors, is)
 		case tokenBracketOpen:
 			as, err := p.parseAttributeSelector()
 			if err != nil {
@@ -82,10 +110,13 @@ loop:
 			s.Selectors = append(s.Selectors, as)
 		case tokenPseudoClass:
 			name := p.next().string
-			if PseudoClasses[name] == nil {
+			match := pseudoClass(name)
+			if match == nil {
 				return nil, errors.New("invalid pseudo selector: :" + name)
 			}
-			s.Selectors = append(s.Selectors, &PseudoSelector{name, PseudoClasses[name]})
+			ps := &PseudoSelector{name, match}
+			p.spans.add(ps, p.span(t.index-1))
+			s.Selectors = append(s.Selectors, ps)
 		case tokenPseudoFunction:
 			ps, err := p.parsePseudoFunctionSelector()
 			if err != nil {
@@ -96,14 +127,33 @@ loop:
 			break loop
 		}
 	}
+	if t := p.peek(); t.category == tokenPseudoElement {
+		e, err := p.parsePseudoElementSelector()
+		if err != nil {
+			return nil, err
+		} else if len(s.Selectors) == 0 {
+			start := t.index - 2 // the :: prefix is not part of the token
+			s.Selectors = append(s.Selectors, &UniversalSelector{"*"})
+			p.spans.add(s.Selectors[0], p.spanAt(start, start))
+			p.spans.add(&s, p.spanAt(start, start))
+			p.element = e
+			return &s, nil
+		}
+		p.element = e
+	}
 	if len(s.Selectors) == 0 {
 		return nil, errors.New("empty simple selector sequence")
 	}
+	span := Span{p.spans.Span(s.Selectors[0]).Start, p.span(0).End}
+	if p.element != nil {
+		span.End = p.spans.Span(p.element).Start
+	}
+	p.spans.add(&s, span)
 	return &s, nil
 }
 
 func (p *parser) parseComplexSelectorSequence(s1 Selector) (Selector, error) {
-	combinator := p.parseCombinator()
+	combinator, combinatorSpan := p.parseCombinator()
 	f := Combinators[combinator]
 	if f == nil {
 		return nil, fmt.Errorf("bad combinator: '%s'", combinator)
@@ -111,11 +161,18 @@ func (p *parser) parseComplexSelectorSequence(s1 Selector) (Selector, error) {
 	s2, err := p.parseSimpleSelectorSequence()
 	if err != nil {
 		return nil, err
+	} else if combinator == "," {
+		if s2, err = p.applyPseudoElement(s2); err != nil {
+			return nil, err
+		}
 	}
-	return f(s1, s2), nil
+	s := f(s1, s2)
+	p.spans.addCombinator(s, Span{p.spans.Span(s1).Start, p.spans.Span(s2).End}, combinatorSpan)
+	return s, nil
 }
 
 func (p *parser) parseAttributeSelector() (Selector, error) {
+	start := p.peek().index
 	if t := p.next(); t.category != tokenBracketOpen {
 		return nil, fmt.Errorf("invalid attribute selector: expected [ but got %#v", t)
 	}
@@ -124,7 +181,9 @@ func (p *parser) parseAttributeSelector() (Selector, error) {
 	}
 	key, matcher := strings.ToLower(p.next().string), p.parseMatcher()
 	if t := p.next(); matcher == "" && t.category == tokenBracketClose {
-		return attributeSelector(key, "", ""), nil
+		as := attributeSelector(key, "", "")
+		p.spans.add(as, p.span(start))
+		return as, nil
 	} else if matcher != "" && (t.category == tokenString || t.category == tokenIdent) {
 		if t := p.next(); t.category != tokenBracketClose {
 			return nil, fmt.Errorf("invalid attribute selector: expected ] but got %#v", t)
@@ -133,42 +192,182 @@ func (p *parser) parseAttributeSelector() (Selector, error) {
 		if t.category == tokenString {
 			value = value[1 : len(value)-1]
 		}
-		return attributeSelector(key, value, matcher), nil
+		as := attributeSelector(key, value, matcher)
+		p.spans.add(as, p.span(start))
+		return as, nil
 	} else {
 		return nil, fmt.Errorf("invalid attribute selector: expected ] or matcher & value but got %#v", t)
 	}
 }
 
 func (p *parser) parsePseudoFunctionSelector() (Selector, error) {
+	start := p.peek().index - 1 // the : prefix is not part of the token
 	name := strings.ToLower(p.next().string)
-	f := PseudoFunctions[name]
+	f := pseudoFunction(name)
 	if f == nil {
 		return nil, errors.New("invalid pseudo function: :" + name)
 	}
 	if p.peek().category != tokenFunctionArguments {
 		return nil, errors.New("expected pseudo function arguments")
 	}
-	args := p.next().string
+	t := p.next()
+	args, argsSpan := t.string, p.spanAt(t.index, t.end)
 	if len(args) != 0 {
-		args = args[1 : len(args)-1] // strip ()
+		args, argsSpan = args[1:len(args)-1], p.spanAt(t.index+1, t.end-1) // strip ()
 	}
-	match, err := f(args)
+	argument, match, err := f(args, p.spans, argsSpan.Start)
 	if err != nil {
 		return nil, err
 	}
-	return &PseudoFunctionSelector{name, args, match}, nil
+	s := &PseudoFunctionSelector{name, args, argument, match}
+	p.spans.add(s, p.span(start))
+	p.spans.addArgs(s, argsSpan)
+	return s, nil
+}
+
+func (p *parser) parsePseudoElementSelector() (*PseudoElementSelector, error) {
+	start := p.peek().index - 2 // the :: prefix is not part of the token
+	name := strings.ToLower(p.next().string)
+	f := pseudoElement(name)
+	if f == nil {
+		return nil, errors.New("invalid pseudo element: ::" + name)
+	} else if p.peek().category != tokenFunctionArguments {
+		return nil, errors.New("expected pseudo element arguments: ::" + name)
+	}
+	t := p.next()
+	args, argsSpan := t.string[1:len(t.string)-1], p.spanAt(t.index+1, t.end-1) // strip ()
+	argument, match, err := f(args, p.spans, argsSpan.Start)
+	if err != nil {
+		return nil, err
+	}
+	e := &PseudoElementSelector{Name: name, Args: args, Argument: argument, match: match}
+	p.spans.add(e, p.span(start))
+	p.spans.addArgs(e, argsSpan)
+	return e, nil
+}
+
+// applyPseudoElement makes s the originating selector of the pending pseudo-element, if any.
+// Pseudo-elements must come last - only another selector of a union may follow them.
+func (p *parser) applyPseudoElement(s Selector) (Selector, error) {
+	e := p.element
+	if e == nil {
+		return s, nil
+	}
+	p.element = nil
+	i := p.index
+	p.acceptRun(tokenSpace)
+	t := p.peek()
+	p.index = i
+	if t.category != tokenEOF && (t.category != tokenCombinator || t.string != ",") {
+		return nil, fmt.Errorf("invalid pseudo element: ::%s must be at the end of the selector", e.Name)
+	}
+	e.Selector = s
+	p.spans.add(e, Span{p.spans.Span(s).Start, p.spans.Span(e).End})
+	return e, nil
+}
+
+// Span returns the span of n. The span of combinator selectors covers both operands.
+func (s *Spans) Span(n Selector) Span {
+	if s == nil || !hasSpan(n) {
+		return Span{}
+	}
+	return s.nodes[n]
+}
+
+// CombinatorSpan returns the span of the combinator of a combinator selector - the whitespace for descendant selectors.
+func (s *Spans) CombinatorSpan(n Selector) Span {
+	if s == nil || !hasSpan(n) {
+		return Span{}
+	}
+	return s.combinators[n]
+}
+
+// ArgsSpan returns the span of the arguments of a pseudo-function or pseudo-element selector - without the ().
+func (s *Spans) ArgsSpan(n Selector) Span {
+	if s == nil || !hasSpan(n) {
+		return Span{}
+	}
+	return s.args[n]
+}
+
+func (s *Spans) add(n Selector, span Span) {
+	if s != nil {
+		s.nodes[n] = span
+	}
+}
+
+func (s *Spans) addArgs(n Selector, span Span) {
+	if s != nil {
+		s.args[n] = span
+	}
+}
+
+// addCombinator records the spans of combinator selectors. Selectors of custom Combinators are left alone.
+func (s *Spans) addCombinator(n Selector, span, combinatorSpan Span) {
+	if s != nil && hasSpan(n) {
+		s.nodes[n], s.combinators[n] = span, combinatorSpan
+	}
+}
+
+// hasSpan checks whether spans are recorded for n - selectors of custom Combinators are not necessarily
+// comparable and cannot be looked up.
+func hasSpan(n Selector) bool {
+	switch n.(type) {
+	case *AttributeSelector, *ClassSelector, *IDSelector, *UniversalSelector, *ElementSelector, *PseudoSelector,
+		*PseudoFunctionSelector, *PseudoElementSelector, *SelectorSequence, *DescendantSelector, *ChildSelector,
+		*NextSiblingSelector, *SubsequentSiblingSelector, *UnionSelector:
+		return true
+	}
+	return false
+}
+
+func pseudoClass(name string) func(*MatchContext, *html.Node) bool {
+	if f := PseudoClassExtensions[name]; f != nil {
+		return f
+	} else if f := PseudoClasses[name]; f != nil {
+		return func(_ *MatchContext, n *html.Node) bool { return f(n) }
+	}
+	return nil
+}
+
+// pseudoFunction returns the compile function of a pseudo-function. Spans of the nodes of parsed arguments
+// are recorded relative to offset, the position of args in the selector string.
+func pseudoFunction(name string) func(args string, spans *Spans, offset int) (Argument, func(*MatchContext, *html.Node) bool, error) {
+	f, ok := PseudoFunctionExtensions[name]
+	if !ok {
+		if f := PseudoFunctions[name]; f != nil {
+			return func(args string, _ *Spans, _ int) (Argument, func(*MatchContext, *html.Node) bool, error) {
+				match, err := f(args)
+				return nil, func(_ *MatchContext, n *html.Node) bool { return match(n) }, err
+			}
+		}
+		return nil
+	}
+	return func(args string, spans *Spans, offset int) (Argument, func(*MatchContext, *html.Node) bool, error) {
+		argument, err := parseArgument(f.Argument, args, spans, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		match, err := f.Compile(argument)
+		if err != nil {
+			return nil, nil, err
+		}
+		return argument, match, nil
+	}
 }
 
-func (p *parser) parseCombinator() string {
-	combinator, space := "", p.peek().category == tokenSpace
+// parseCombinator returns the combinator and its span - for the descendant combinator that is the whitespace.
+func (p *parser) parseCombinator() (string, Span) {
+	t := p.peek()
+	combinator, span, space := "", p.spanAt(t.index, t.index), t.category == tokenSpace
 	p.acceptRun(tokenSpace)
-	if p.peek().category == tokenCombinator {
-		combinator = p.next().string
+	if t := p.peek(); t.category == tokenCombinator {
+		combinator, span = p.next().string, p.spanAt(t.index, t.end)
 	} else if space {
-		combinator = " "
+		combinator, span = " ", p.span(t.index)
 	}
 	p.acceptRun(tokenSpace)
-	return combinator
+	return combinator, span
 }
 
 func (p *parser) parseMatcher() string {
@@ -0,0 +1,362 @@
+package css
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Program is a selector lowered into a flat list of instructions executed by a small backtracking vm.
+// Like the Selector AST it matches right to left - but in a single loop rather than through recursive Match calls.
+// Programs can be serialized via MarshalBinary and UnmarshalBinary.
+// Selectors the vm does not know (e.g. pseudo-classes) are kept as fallbacks and matched via their Match method.
+type Program struct {
+	source       string
+	instructions []instruction
+	strings      []string
+	matchers     []string
+	fallbacks    []string
+	// linked
+	atoms      []atom.Atom
+	matchFuncs []func(string, string) bool
+	selectors  []Selector
+}
+
+type instruction struct {
+	op      opcode
+	a, b, c int
+}
+
+type opcode byte
+
+const (
+	opMatch        opcode = iota
+	opElement             // n is an element of type strings[a]
+	opAttribute           // matchers[c](attribute strings[a], strings[b])
+	opFallback            // selectors[a].Match(n)
+	opParent              // move to the parent element
+	opPrevSibling         // move to the previous sibling element
+	opAncestor            // move to the closest ancestor element - retrying with the next one on failure
+	opPrevSiblings        // move to the previous sibling element - retrying with the one before on failure
+	opFork                // continue with the next instruction - retrying from instruction a on failure
+)
+
+const programVersion = 1
+
+type backtrack struct {
+	op opcode
+	pc int
+	n  *html.Node
+}
+
+func CompileProgram(selector string) (*Program, error) {
+	s, err := Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+	return NewProgram(s), nil
+}
+
+func MustCompileProgram(selector string) *Program {
+	p, err := CompileProgram(selector)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func NewProgram(s Selector) *Program {
+	p := &Program{source: s.String()}
+	p.lower(s, true)
+	p.emit(opMatch, 0, 0, 0)
+	return p
+}
+
+func (p *Program) String() string { return p.source }
+
+func (p *Program) Match(n *html.Node) bool {
+	var buffer [8]backtrack
+	stack, pc := buffer[:0], 0
+	for {
+		ok := true
+		switch in := p.instructions[pc]; in.op {
+		case opMatch:
+			return true
+		case opElement:
+			ok = isElement(n, p.atoms[in.a], p.strings[in.a])
+		case opAttribute:
+			ok = false
+			for _, a := range n.Attr {
+				if a.Key == p.strings[in.a] {
+					ok = p.matchFuncs[in.c](a.Val, p.strings[in.b])
+					break
+				}
+			}
+		case opFallback:
+			ok = p.selectors[in.a].Match(n)
+		case opParent:
+			n = n.Parent
+			ok = isElementNode(n)
+		case opPrevSibling:
+			n = n.PrevSibling
+			ok = isElementNode(n)
+		case opAncestor, opPrevSiblings:
+			if n = step(in.op, n); n != nil {
+				stack = append(stack, backtrack{in.op, pc + 1, n})
+			}
+			ok = n != nil
+		case opFork:
+			stack = append(stack, backtrack{in.op, in.a, n})
+		}
+		if ok {
+			pc++
+			continue
+		}
+		for {
+			if len(stack) == 0 {
+				return false
+			}
+			b := &stack[len(stack)-1]
+			if b.op == opFork {
+				pc, n, stack = b.pc, b.n, stack[:len(stack)-1]
+				break
+			} else if b.n = step(b.op, b.n); b.n != nil {
+				pc, n = b.pc, b.n
+				break
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// step moves from n to the next ancestor or previous sibling element.
+func step(op opcode, n *html.Node) *html.Node {
+	for {
+		if op == opAncestor {
+			n = n.Parent
+		} else {
+			n = n.PrevSibling
+		}
+		if n == nil || n.Type == html.ElementNode {
+			return n
+		}
+	}
+}
+
+// lower appends the instructions for s. Unions can only be lowered if nothing follows them (i.e. final) -
+// otherwise they are kept as fallbacks.
+func (p *Program) lower(s Selector, final bool) {
+	switch s := s.(type) {
+	case *SelectorSequence:
+		for _, s := range s.Selectors {
+			p.lowerSimple(s)
+		}
+	case *DescendantSelector:
+		p.lower(s.Selector, false)
+		p.emit(opAncestor, 0, 0, 0)
+		p.lower(s.Ancestor, final)
+	case *ChildSelector:
+		p.lower(s.Selector, false)
+		p.emit(opParent, 0, 0, 0)
+		p.lower(s.Parent, final)
+	case *NextSiblingSelector:
+		p.lower(s.Selector, false)
+		p.emit(opPrevSibling, 0, 0, 0)
+		p.lower(s.Sibling, final)
+	case *SubsequentSiblingSelector:
+		p.lower(s.Selector, false)
+		p.emit(opPrevSiblings, 0, 0, 0)
+		p.lower(s.Sibling, final)
+	case *UnionSelector:
+		if !final {
+			p.fallback(s)
+			return
+		}
+		fork := p.emit(opFork, 0, 0, 0)
+		p.lower(s.SelectorA, true)
+		p.emit(opMatch, 0, 0, 0)
+		p.instructions[fork].a = len(p.instructions)
+		p.lower(s.SelectorB, true)
+	default:
+		p.fallback(s)
+	}
+}
+
+func (p *Program) lowerSimple(s Selector) {
+	switch s := s.(type) {
+	case *UniversalSelector:
+	case *ElementSelector:
+		p.emit(opElement, p.intern(s.Element), 0, 0)
+	case *IDSelector:
+		p.lowerAttribute(s.AttributeSelector)
+	case *ClassSelector:
+		p.lowerAttribute(s.AttributeSelector)
+	case *AttributeSelector:
+		p.lowerAttribute(s)
+	default:
+		p.fallback(s)
+	}
+}
+
+func (p *Program) lowerAttribute(s *AttributeSelector) {
+	for i, m := range p.matchers {
+		if m == s.Type {
+			p.emit(opAttribute, p.intern(s.Key), p.intern(s.Value), i)
+			return
+		}
+	}
+	p.matchers, p.matchFuncs = append(p.matchers, s.Type), append(p.matchFuncs, s.match)
+	p.emit(opAttribute, p.intern(s.Key), p.intern(s.Value), len(p.matchers)-1)
+}
+
+func (p *Program) fallback(s Selector) {
+	p.fallbacks, p.selectors = append(p.fallbacks, s.String()), append(p.selectors, s)
+	p.emit(opFallback, len(p.fallbacks)-1, 0, 0)
+}
+
+func (p *Program) emit(op opcode, a, b, c int) int {
+	p.instructions = append(p.instructions, instruction{op, a, b, c})
+	return len(p.instructions) - 1
+}
+
+func (p *Program) intern(s string) int {
+	for i, x := range p.strings {
+		if x == s {
+			return i
+		}
+	}
+	p.strings, p.atoms = append(p.strings, s), append(p.atoms, atom.Lookup([]byte(s)))
+	return len(p.strings) - 1
+}
+
+func (p *Program) MarshalBinary() ([]byte, error) {
+	bs := []byte{programVersion}
+	for _, strings := range [][]string{{p.source}, p.strings, p.matchers, p.fallbacks} {
+		bs = binary.AppendUvarint(bs, uint64(len(strings)))
+		for _, s := range strings {
+			bs = append(binary.AppendUvarint(bs, uint64(len(s))), s...)
+		}
+	}
+	bs = binary.AppendUvarint(bs, uint64(len(p.instructions)))
+	for _, in := range p.instructions {
+		bs = append(bs, byte(in.op))
+		for _, x := range []int{in.a, in.b, in.c} {
+			bs = binary.AppendUvarint(bs, uint64(x))
+		}
+	}
+	return bs, nil
+}
+
+// UnmarshalBinary decodes a program and links it against the current Matchers and pseudo-classes.
+func (p *Program) UnmarshalBinary(bs []byte) error {
+	d := decoder{bs: bs}
+	if version := d.byte(); version != programVersion {
+		return fmt.Errorf("unsupported program version: %d", version)
+	}
+	tables := make([][]string, 4)
+	for i := range tables {
+		tables[i] = make([]string, d.uvarint(len(bs)))
+		for j := range tables[i] {
+			tables[i][j] = d.string()
+		}
+	}
+	if len(tables[0]) != 1 {
+		return errors.New("invalid program: missing source")
+	}
+	q := &Program{source: tables[0][0], strings: tables[1], matchers: tables[2], fallbacks: tables[3]}
+	q.instructions = make([]instruction, d.uvarint(len(bs)))
+	for i := range q.instructions {
+		q.instructions[i] = instruction{opcode(d.byte()), d.uvarint(len(bs)), d.uvarint(len(bs)), d.uvarint(len(bs))}
+	}
+	if d.err != nil {
+		return d.err
+	} else if err := q.link(); err != nil {
+		return err
+	}
+	*p = *q
+	return nil
+}
+
+func (p *Program) link() error {
+	p.matchFuncs, p.selectors = make([]func(string, string) bool, len(p.matchers)), make([]Selector, len(p.fallbacks))
+	p.atoms = make([]atom.Atom, len(p.strings))
+	for i, s := range p.strings {
+		p.atoms[i] = atom.Lookup([]byte(s))
+	}
+	for i, m := range p.matchers {
+		if p.matchFuncs[i] = Matchers[m]; p.matchFuncs[i] == nil {
+			return fmt.Errorf("invalid program: unknown matcher %q", m)
+		}
+	}
+	for i, f := range p.fallbacks {
+		s, err := Compile(f)
+		if err != nil {
+			return fmt.Errorf("invalid program: %s", err)
+		}
+		p.selectors[i] = s
+	}
+	for i, in := range p.instructions {
+		ok := true
+		switch in.op {
+		case opMatch, opParent, opPrevSibling, opAncestor, opPrevSiblings:
+		case opElement:
+			ok = in.a < len(p.strings)
+		case opAttribute:
+			ok = in.a < len(p.strings) && in.b < len(p.strings) && in.c < len(p.matchers)
+		case opFallback:
+			ok = in.a < len(p.fallbacks)
+		case opFork:
+			ok = in.a > i && in.a < len(p.instructions)
+		default:
+			ok = false
+		}
+		if !ok {
+			return fmt.Errorf("invalid program: bad instruction %d: %#v", i, in)
+		}
+	}
+	if len(p.instructions) == 0 || p.instructions[len(p.instructions)-1].op != opMatch {
+		return errors.New("invalid program: must end with match instruction")
+	}
+	return nil
+}
+
+type decoder struct {
+	bs  []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.bs) == 0 {
+		d.err = errors.New("invalid program: unexpected end of input")
+		return 0
+	}
+	b := d.bs[0]
+	d.bs = d.bs[1:]
+	return b
+}
+
+// uvarint decodes an unsigned varint - values greater than max are invalid.
+func (d *decoder) uvarint(max int) int {
+	x, n := binary.Uvarint(d.bs)
+	if d.err == nil && (n <= 0 || x > uint64(max)) {
+		d.err = errors.New("invalid program: bad varint")
+	}
+	if d.err != nil {
+		return 0
+	}
+	d.bs = d.bs[n:]
+	return int(x)
+}
+
+func (d *decoder) string() string {
+	l := d.uvarint(len(d.bs))
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.bs[:l])
+	d.bs = d.bs[l:]
+	return s
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package css
+
+// raceEnabled is set when testing with the race detector - which makes sync.Pool drop items on purpose.
+const raceEnabled = true
@@ -0,0 +1,213 @@
+package css
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Selection is a list of nodes with a chainable api modeled after goquery - built on Compile and All.
+// Selectors are compiled via a shared Cache. Like in goquery, invalid selectors match no nodes.
+// Methods returning a Selection never modify the receiver and contain each node at most once.
+type Selection struct {
+	Nodes []*html.Node
+}
+
+var selections = NewCache(256)
+
+// NewSelection returns a selection of the given nodes.
+func NewSelection(nodes ...*html.Node) *Selection {
+	return &Selection{nodes}
+}
+
+// Find returns the descendants of the nodes of the selection matched by selector.
+// All of them are queried with the same MatchContext, i.e. positions and texts are computed only once.
+func (s *Selection) Find(selector string) *Selection {
+	compiled, err := selections.Compile(selector)
+	if err != nil {
+		return NewSelection()
+	}
+	q := newQuery(compiled)
+	defer q.release()
+	return s.flatMap(func(n *html.Node) (ns []*html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			ns = q.all(c, q.filter(c), ns)
+		}
+		return ns
+	})
+}
+
+// Filter returns the nodes of the selection matched by selector.
+func (s *Selection) Filter(selector string) *Selection {
+	compiled, err := selections.Compile(selector)
+	if err != nil {
+		return NewSelection()
+	}
+	return s.filter(func(n *html.Node) bool { return Matches(compiled, n) })
+}
+
+// Not returns the nodes of the selection not matched by selector.
+func (s *Selection) Not(selector string) *Selection {
+	compiled, err := selections.Compile(selector)
+	if err != nil {
+		return NewSelection()
+	}
+	return s.filter(func(n *html.Node) bool { return !Matches(compiled, n) })
+}
+
+// Has returns the nodes of the selection with a descendant matched by selector.
+// Like Find, it queries all of them with the same MatchContext.
+func (s *Selection) Has(selector string) *Selection {
+	compiled, err := selections.Compile(selector)
+	if err != nil {
+		return NewSelection()
+	}
+	q := newQuery(compiled)
+	defer q.release()
+	return s.filter(func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if q.first(c, q.filter(c)) != nil {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Parent returns the parent elements of the nodes of the selection.
+func (s *Selection) Parent() *Selection {
+	return s.flatMap(func(n *html.Node) []*html.Node {
+		if isElementNode(n.Parent) {
+			return []*html.Node{n.Parent}
+		}
+		return nil
+	})
+}
+
+// Parents returns the ancestor elements of the nodes of the selection - nearest first.
+func (s *Selection) Parents() *Selection {
+	return s.flatMap(func(n *html.Node) []*html.Node { return ParentsUntil(nil, n) })
+}
+
+// Children returns the child elements of the nodes of the selection.
+func (s *Selection) Children() *Selection {
+	return s.flatMap(func(n *html.Node) (ns []*html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				ns = append(ns, c)
+			}
+		}
+		return ns
+	})
+}
+
+// Siblings returns the sibling elements of the nodes of the selection - excluding the nodes themselves.
+func (s *Selection) Siblings() *Selection {
+	return s.flatMap(func(n *html.Node) (ns []*html.Node) {
+		if n.Parent == nil {
+			return nil
+		}
+		for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && c != n {
+				ns = append(ns, c)
+			}
+		}
+		return ns
+	})
+}
+
+// Each calls f for each node of the selection with its index and a selection of just that node.
+func (s *Selection) Each(f func(int, *Selection)) *Selection {
+	for i, n := range s.Nodes {
+		f(i, NewSelection(n))
+	}
+	return s
+}
+
+// Map returns the results of calling f for each node of the selection with its index and a selection of just that node.
+func (s *Selection) Map(f func(int, *Selection) string) []string {
+	out := make([]string, len(s.Nodes))
+	for i, n := range s.Nodes {
+		out[i] = f(i, NewSelection(n))
+	}
+	return out
+}
+
+// Attr returns the value of the attribute key of the first node of the selection.
+func (s *Selection) Attr(key string) (string, bool) {
+	if len(s.Nodes) == 0 {
+		return "", false
+	}
+	for _, a := range s.Nodes[0].Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// Text returns the combined text content of the nodes of the selection.
+func (s *Selection) Text() string {
+	b := &strings.Builder{}
+	for _, n := range s.Nodes {
+		writeText(b, n, nil, false, nil)
+	}
+	return b.String()
+}
+
+// Html returns the html of the children of the first node of the selection.
+func (s *Selection) Html() (string, error) {
+	if len(s.Nodes) == 0 {
+		return "", nil
+	}
+	b := &strings.Builder{}
+	for c := s.Nodes[0].FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(b, c); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// Eq returns a selection of the node at index i - negative indexes count from the end.
+// The selection is empty if i is out of range.
+func (s *Selection) Eq(i int) *Selection {
+	if i < 0 {
+		i += len(s.Nodes)
+	}
+	if i < 0 || i >= len(s.Nodes) {
+		return NewSelection()
+	}
+	return NewSelection(s.Nodes[i])
+}
+
+// First returns a selection of the first node of the selection.
+func (s *Selection) First() *Selection { return s.Eq(0) }
+
+// Last returns a selection of the last node of the selection.
+func (s *Selection) Last() *Selection { return s.Eq(-1) }
+
+func (s *Selection) filter(f func(*html.Node) bool) *Selection {
+	var ns []*html.Node
+	for _, n := range s.Nodes {
+		if f(n) {
+			ns = append(ns, n)
+		}
+	}
+	return NewSelection(ns...)
+}
+
+// flatMap returns a selection of the nodes returned by f for each node of the selection - without duplicates.
+func (s *Selection) flatMap(f func(*html.Node) []*html.Node) *Selection {
+	var ns []*html.Node
+	seen := map[*html.Node]bool{}
+	for _, n := range s.Nodes {
+		for _, m := range f(n) {
+			if !seen[m] {
+				seen[m] = true
+				ns = append(ns, m)
+			}
+		}
+	}
+	return NewSelection(ns...)
+}
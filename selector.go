@@ -2,9 +2,11 @@ package css
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 type Selector interface {
@@ -12,6 +14,79 @@ type Selector interface {
 	String() string
 }
 
+// MatchContext carries state shared by the Match calls of a single traversal - e.g. cached sibling positions.
+// A nil *MatchContext is valid and disables caching.
+// Extensions receive the MatchContext of the traversal and should pass it on via its methods.
+// A MatchContext can be reused for multiple traversals as long as the document does not change.
+type MatchContext struct {
+	// State is consulted by dynamic pseudo-classes like :hover and :focus. Without it no element is
+	// in any of these states (i.e. all media is paused). Like the document, it must not change while the
+	// MatchContext is in use.
+	State ElementState
+	// PierceShadowRoots makes traversals descend into declarative shadow roots. Without it they are separate
+	// scopes - only the ::part branches of a selector match elements of the shadow trees of the visited hosts.
+	PierceShadowRoots bool
+	// TemplateContents makes traversals descend into the contents of template elements. Without it they are
+	// not part of the document - like in browsers. See AllInTemplate for querying them on their own.
+	TemplateContents bool
+	// Scope is the root of a tree the traversals are limited to, e.g. a template element for its contents.
+	// Traversals starting at it visit its descendants but not Scope itself - and combinators do not reach it
+	// or its ancestors.
+	Scope *html.Node
+
+	index     *Index
+	positions map[*html.Node]position
+	// types is used to count the children of each type when computing positions.
+	types map[elementType]int
+	// content is the text content of the tree of textRoot, texts the spans of its elements in it.
+	content  string
+	texts    map[*html.Node]span
+	textRoot *html.Node
+	// focused contains the elements of the tree of focusRoot matched by :focus-within.
+	focused   map[*html.Node]bool
+	focusRoot *html.Node
+}
+
+// ElementState provides the dynamic state of elements, e.g. as known by a browser or test harness.
+type ElementState interface {
+	// Is reports whether n is in the given state.
+	Is(n *html.Node, state State) bool
+}
+
+// ElementStateFunc adapts a function to the ElementState interface.
+type ElementStateFunc func(*html.Node, State) bool
+
+func (f ElementStateFunc) Is(n *html.Node, state State) bool { return f(n, state) }
+
+// State is a dynamic state of an element.
+type State int
+
+const (
+	Hover        State = iota + 1 // :hover
+	Active                        // :active
+	Focus                         // :focus and :focus-within of its ancestors
+	FocusVisible                  // :focus-visible
+	Visited                       // :visited
+	Playing                       // :playing - media that is not playing is :paused
+)
+
+// ContextSelector is implemented by selectors that make use of the MatchContext of a traversal.
+// All selectors of this package implement it - their Match is MatchWith without a context.
+// Custom selectors implementing only Selector keep working and are matched via Match.
+type ContextSelector interface {
+	Selector
+	MatchWith(*MatchContext, *html.Node) bool
+}
+
+// Span is the byte range [Start, End) of a node in the selector string it was compiled from.
+type Span struct{ Start, End int }
+
+// Spans holds the Span of each node of a selector compiled via CompileWithSpans - including the nodes of
+// selector arguments like :not(...). Nodes that were not compiled from that string have a zero Span.
+type Spans struct {
+	nodes, combinators, args map[Selector]Span
+}
+
 type AttributeSelector struct {
 	Key   string
 	Value string
@@ -29,17 +104,73 @@ type UniversalSelector struct {
 
 type PseudoSelector struct {
 	Name  string
-	match func(*html.Node) bool
+	match func(*MatchContext, *html.Node) bool
 }
 
+// PseudoFunctionSelector holds both the raw Args and, for built-ins, the parsed Argument.
+// Custom PseudoFunctions parse their own arguments and have a nil Argument.
 type PseudoFunctionSelector struct {
-	Name  string
-	Args  string
-	match func(*html.Node) bool
+	Name     string
+	Args     string
+	Argument Argument `json:",omitempty"`
+	match    func(*MatchContext, *html.Node) bool
+}
+
+// PseudoElementSelector matches the elements a pseudo-element refers to, e.g. x-button::part(label).
+// Selector is matched against their originating element - the shadow host for ::part and the slot for ::slotted.
+type PseudoElementSelector struct {
+	Selector Selector
+	Name     string
+	Args     string
+	Argument Argument `json:",omitempty"`
+	match    func(*MatchContext, *html.Node) *html.Node
+}
+
+// Argument is the parsed argument of a PseudoFunctionSelector.
+type Argument interface {
+	String() string
+}
+
+// SelectorArgument is a selector list, e.g. :not(.a, .b).
+type SelectorArgument struct {
+	Selector Selector
+}
+
+// NthArgument is an An+B expression, e.g. :nth-child(2n+1). odd and even are 2n+1 and 2n.
+type NthArgument struct {
+	A, B int
+}
+
+// StringArgument is a string - the quotes are optional, e.g. :contains("foo").
+type StringArgument struct {
+	Value string
+}
+
+// IdentifierArgument is a comma separated list of identifiers, e.g. :lang(en, de).
+type IdentifierArgument struct {
+	Identifiers []string
+}
+
+// NumberArgument is a number, e.g. :upward(2).
+type NumberArgument struct {
+	Value float64
+}
+
+// RelativeSelectorArgument is a list of selectors relative to the matched element, e.g. :has(> img, + p).
+type RelativeSelectorArgument struct {
+	Selectors []RelativeSelector
+}
+
+// RelativeSelector is a selector with a leading combinator - the descendant combinator if none is given.
+type RelativeSelector struct {
+	Combinator string
+	Selector   Selector
 }
 
 type ElementSelector struct {
 	Element string
+	// atom is the atom of Element - 0 for custom and unknown elements, which are compared by name.
+	atom atom.Atom
 }
 
 type SelectorSequence struct {
@@ -72,32 +203,88 @@ type UnionSelector struct {
 }
 
 var PseudoClasses = map[string]func(*html.Node) bool{
-	"root":          isRoot,
-	"empty":         isEmpty,
-	"checked":       func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "checked") },
-	"disabled":      func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "disabled") },
-	"enabled":       func(n *html.Node) bool { return isInput(n) && !hasAttribute(n, "disabled") },
-	"optional":      func(n *html.Node) bool { return isInput(n) && !hasAttribute(n, "required") },
-	"required":      func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "required") },
-	"read-only":     func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "readonly") },
-	"read-write":    func(n *html.Node) bool { return isInput(n) && !hasAttribute(n, "readonly") },
-	"first-child":   nthSiblingCompiled(func(n *html.Node) *html.Node { return n.PrevSibling }, "1", false),
-	"first-of-type": nthSiblingCompiled(func(n *html.Node) *html.Node { return n.PrevSibling }, "1", true),
-	"last-child":    nthSiblingCompiled(func(n *html.Node) *html.Node { return n.NextSibling }, "1", false),
-	"last-of-type":  nthSiblingCompiled(func(n *html.Node) *html.Node { return n.NextSibling }, "1", true),
+	"root":       isRoot,
+	"empty":      isEmpty,
+	"checked":    func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "checked") },
+	"disabled":   func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "disabled") },
+	"enabled":    func(n *html.Node) bool { return isInput(n) && !hasAttribute(n, "disabled") },
+	"optional":   func(n *html.Node) bool { return isInput(n) && !hasAttribute(n, "required") },
+	"required":   func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "required") },
+	"read-only":  func(n *html.Node) bool { return isInput(n) && hasAttribute(n, "readonly") },
+	"read-write": func(n *html.Node) bool { return isInput(n) && !hasAttribute(n, "readonly") },
+	// context-free versions of the structural PseudoClassExtensions - they do not use the cached sibling positions
+	"first-child":   contextFree(nth(0, 1, false, false)),
+	"first-of-type": contextFree(nth(0, 1, false, true)),
+	"last-child":    contextFree(nth(0, 1, true, false)),
+	"last-of-type":  contextFree(nth(0, 1, true, true)),
+	"only-child":    contextFree(onlyChild(false)),
+	"only-of-type":  contextFree(onlyChild(true)),
+}
+
+// PseudoFunctions contains pseudo-functions that parse their own arguments - including context-free versions of
+// the built-in PseudoFunctionExtensions.
+var PseudoFunctions = map[string]func(string) (func(*html.Node) bool, error){}
+
+// PseudoClassExtensions contains pseudo-classes that have access to the MatchContext of the traversal - e.g. to
+// make use of the cached sibling positions or the ElementState. They take precedence over PseudoClasses.
+var PseudoClassExtensions = map[string]func(*MatchContext, *html.Node) bool{
+	"first-child":   nth(0, 1, false, false),
+	"first-of-type": nth(0, 1, false, true),
+	"last-child":    nth(0, 1, true, false),
+	"last-of-type":  nth(0, 1, true, true),
 	"only-child":    onlyChild(false),
 	"only-of-type":  onlyChild(true),
+	"hover":         hasState(Hover),
+	"active":        hasState(Active),
+	"focus":         hasState(Focus),
+	"focus-visible": hasState(FocusVisible),
+	"focus-within":  focusWithin,
+	"host":          isScopedHost,
+	"visited":       hasState(Visited),
+	"playing":       func(c *MatchContext, n *html.Node) bool { return isMedia(n) && c.is(n, Playing) },
+	"paused":        func(c *MatchContext, n *html.Node) bool { return isMedia(n) && !c.is(n, Playing) },
+}
+
+// PseudoFunctionExtensions contains pseudo-functions that declare the kind of their argument rather than parsing it
+// themselves. They receive the parsed argument and have access to the MatchContext of the traversal.
+// They take precedence over PseudoFunctions.
+var PseudoFunctionExtensions = map[string]PseudoFunctionExtension{
+	"contains":         {StringKind, contains},
+	"host":             {SelectorListKind, host},
+	"host-context":     {SelectorListKind, hostContext},
+	"lang":             {IdentifierKind, lang},
+	"not":              {SelectorListKind, not},
+	"nth-child":        {NthKind, nthSibling(false, false)},
+	"nth-last-child":   {NthKind, nthSibling(true, false)},
+	"nth-of-type":      {NthKind, nthSibling(false, true)},
+	"nth-last-of-type": {NthKind, nthSibling(true, true)},
+}
+
+func init() {
+	// the built-ins used to be PseudoFunctions - keep them for callers that read or wrap them
+	for _, name := range []string{"not", "nth-child", "nth-last-child", "nth-of-type", "nth-last-of-type", "contains"} {
+		PseudoFunctions[name] = contextFreeFunction(PseudoFunctionExtensions[name])
+	}
 }
 
-var PseudoFunctions = map[string]func(string) (func(*html.Node) bool, error){
-	"not":              nil,
-	"nth-child":        nthSibling(func(n *html.Node) *html.Node { return n.PrevSibling }, false),
-	"nth-last-child":   nthSibling(func(n *html.Node) *html.Node { return n.NextSibling }, false),
-	"nth-of-type":      nthSibling(func(n *html.Node) *html.Node { return n.PrevSibling }, true),
-	"nth-last-of-type": nthSibling(func(n *html.Node) *html.Node { return n.NextSibling }, true),
-	"contains":         contains,
+type PseudoFunctionExtension struct {
+	Argument ArgumentKind
+	// Compile is called with the parsed argument and returns the match function - or an error for invalid arguments.
+	Compile func(Argument) (func(*MatchContext, *html.Node) bool, error)
 }
 
+// ArgumentKind is the kind of argument a pseudo-function accepts and the type of the Argument it receives.
+type ArgumentKind int
+
+const (
+	SelectorListKind         ArgumentKind = iota + 1 // *SelectorArgument
+	RelativeSelectorListKind                         // *RelativeSelectorArgument
+	NthKind                                          // *NthArgument
+	StringKind                                       // *StringArgument
+	NumberKind                                       // *NumberArgument
+	IdentifierKind                                   // *IdentifierArgument
+)
+
 var Matchers = map[string]func(string, string) bool{
 	"~=": includeMatch,
 	"|=": func(av, sv string) bool { return av == sv || strings.HasPrefix(av, sv+"-") },
@@ -109,25 +296,88 @@ var Matchers = map[string]func(string, string) bool{
 }
 
 var Combinators = map[string]func(Selector, Selector) Selector{
-	" ": func(s1, s2 Selector) Selector { return &DescendantSelector{s1, s2} },
-	">": func(s1, s2 Selector) Selector { return &ChildSelector{s1, s2} },
-	"+": func(s1, s2 Selector) Selector { return &NextSiblingSelector{s1, s2} },
-	"~": func(s1, s2 Selector) Selector { return &SubsequentSiblingSelector{s1, s2} },
-	",": func(s1, s2 Selector) Selector { return &UnionSelector{s1, s2} },
+	" ": func(s1, s2 Selector) Selector { return &DescendantSelector{Ancestor: s1, Selector: s2} },
+	">": func(s1, s2 Selector) Selector { return &ChildSelector{Parent: s1, Selector: s2} },
+	"+": func(s1, s2 Selector) Selector { return &NextSiblingSelector{Sibling: s1, Selector: s2} },
+	"~": func(s1, s2 Selector) Selector { return &SubsequentSiblingSelector{Sibling: s1, Selector: s2} },
+	",": func(s1, s2 Selector) Selector { return &UnionSelector{SelectorA: s1, SelectorB: s2} },
 }
 
-func init() {
-	PseudoFunctions["not"] = func(args string) (func(*html.Node) bool, error) {
-		s, err := Compile(args)
-		return func(n *html.Node) bool { return isElementNode(n) && !s.Match(n) }, err
+// First returns the first node matched by s with the state of c.
+func (c *MatchContext) First(s Selector, n *html.Node) *html.Node {
+	q := newContextQuery(c, s)
+	return q.first(n, q.filter(n))
+}
+
+// All returns all nodes matched by s with the state of c.
+func (c *MatchContext) All(s Selector, n *html.Node) []*html.Node {
+	q := newContextQuery(c, s)
+	return q.all(n, q.filter(n), nil)
+}
+
+// Count returns the number of nodes matched by s with the state of c.
+func (c *MatchContext) Count(s Selector, n *html.Node) int {
+	q := newContextQuery(c, s)
+	return q.count(n, q.filter(n))
+}
+
+// Match matches s against n as part of the traversal of c.
+func (c *MatchContext) Match(s Selector, n *html.Node) bool { return matchWith(c, s, n) }
+
+// matchWith matches s against n - passing c along if s is a ContextSelector.
+func matchWith(c *MatchContext, s Selector, n *html.Node) bool {
+	if s, ok := s.(ContextSelector); ok {
+		return s.MatchWith(c, n)
 	}
+	return s.Match(n)
 }
 
-func (s *UniversalSelector) Match(n *html.Node) bool      { return true }
-func (s *PseudoSelector) Match(n *html.Node) bool         { return s.match(n) }
-func (s *PseudoFunctionSelector) Match(n *html.Node) bool { return s.match(n) }
-func (s *ElementSelector) Match(n *html.Node) bool        { return n.Data == s.Element }
-func (s *AttributeSelector) Match(n *html.Node) bool {
+// needsContext checks whether s contains selectors that make use of the MatchContext.
+func needsContext(s Selector) bool {
+	switch s := s.(type) {
+	case *PseudoSelector, *PseudoFunctionSelector, *PseudoElementSelector:
+		return true
+	case *SelectorSequence:
+		for _, s := range s.Selectors {
+			if needsContext(s) {
+				return true
+			}
+		}
+	case *UnionSelector:
+		return needsContext(s.SelectorA) || needsContext(s.SelectorB)
+	case *DescendantSelector:
+		return needsContext(s.Ancestor) || needsContext(s.Selector)
+	case *ChildSelector:
+		return needsContext(s.Parent) || needsContext(s.Selector)
+	case *NextSiblingSelector:
+		return needsContext(s.Sibling) || needsContext(s.Selector)
+	case *SubsequentSiblingSelector:
+		return needsContext(s.Sibling) || needsContext(s.Selector)
+	}
+	return false
+}
+
+func (s *UniversalSelector) Match(n *html.Node) bool         { return s.MatchWith(nil, n) }
+func (s *ElementSelector) Match(n *html.Node) bool           { return s.MatchWith(nil, n) }
+func (s *AttributeSelector) Match(n *html.Node) bool         { return s.MatchWith(nil, n) }
+func (s *PseudoSelector) Match(n *html.Node) bool            { return s.MatchWith(nil, n) }
+func (s *PseudoFunctionSelector) Match(n *html.Node) bool    { return s.MatchWith(nil, n) }
+func (s *PseudoElementSelector) Match(n *html.Node) bool     { return s.MatchWith(nil, n) }
+func (s *UnionSelector) Match(n *html.Node) bool             { return s.MatchWith(nil, n) }
+func (s *SelectorSequence) Match(n *html.Node) bool          { return s.MatchWith(nil, n) }
+func (s *DescendantSelector) Match(n *html.Node) bool        { return s.MatchWith(nil, n) }
+func (s *ChildSelector) Match(n *html.Node) bool             { return s.MatchWith(nil, n) }
+func (s *SubsequentSiblingSelector) Match(n *html.Node) bool { return s.MatchWith(nil, n) }
+func (s *NextSiblingSelector) Match(n *html.Node) bool       { return s.MatchWith(nil, n) }
+
+func (s *UniversalSelector) MatchWith(c *MatchContext, n *html.Node) bool { return true }
+func (s *ElementSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	return isElement(n, s.atom, s.Element)
+}
+func (s *PseudoSelector) MatchWith(c *MatchContext, n *html.Node) bool         { return s.match(c, n) }
+func (s *PseudoFunctionSelector) MatchWith(c *MatchContext, n *html.Node) bool { return s.match(c, n) }
+
+func (s *AttributeSelector) MatchWith(c *MatchContext, n *html.Node) bool {
 	for _, a := range n.Attr {
 		if a.Key == s.Key {
 			return s.match(a.Val, s.Value)
@@ -136,49 +386,58 @@ func (s *AttributeSelector) Match(n *html.Node) bool {
 	return false
 }
 
-func (s *UnionSelector) Match(n *html.Node) bool {
-	return s.SelectorA.Match(n) || s.SelectorB.Match(n)
+func (s *PseudoElementSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	o := s.match(c, n)
+	return o != nil && matchWith(c, s.Selector, o)
+}
+
+func (s *UnionSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	return matchWith(c, s.SelectorA, n) || matchWith(c, s.SelectorB, n)
 }
 
-func (s *SelectorSequence) Match(n *html.Node) bool {
+func (s *SelectorSequence) MatchWith(c *MatchContext, n *html.Node) bool {
 	for _, s := range s.Selectors {
-		if !s.Match(n) {
+		if !matchWith(c, s, n) {
 			return false
 		}
 	}
 	return true
 }
 
-func (s *DescendantSelector) Match(n *html.Node) bool {
-	if !s.Selector.Match(n) {
+func (s *DescendantSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	if !matchWith(c, s.Selector, n) {
 		return false
 	}
-	for n := n.Parent; n != nil; n = n.Parent {
-		if n.Type == html.ElementNode && s.Ancestor.Match(n) {
+	for n := c.parent(n); n != nil; n = c.parent(n) {
+		if n.Type == html.ElementNode && matchWith(c, s.Ancestor, n) {
 			return true
 		}
 	}
 	return false
 }
 
-func (s *ChildSelector) Match(n *html.Node) bool {
-	return s.Selector.Match(n) && isElementNode(n.Parent) && s.Parent.Match(n.Parent)
+func (s *ChildSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	if !matchWith(c, s.Selector, n) {
+		return false
+	}
+	p := c.parent(n)
+	return isElementNode(p) && matchWith(c, s.Parent, p)
 }
 
-func (s *SubsequentSiblingSelector) Match(n *html.Node) bool {
-	if !s.Selector.Match(n) {
+func (s *SubsequentSiblingSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	if !matchWith(c, s.Selector, n) {
 		return false
 	}
 	for n := n.PrevSibling; n != nil; n = n.PrevSibling {
-		if n.Type == html.ElementNode && s.Sibling.Match(n) {
+		if n.Type == html.ElementNode && matchWith(c, s.Sibling, n) {
 			return true
 		}
 	}
 	return false
 }
 
-func (s *NextSiblingSelector) Match(n *html.Node) bool {
-	return s.Selector.Match(n) && isElementNode(n.PrevSibling) && s.Sibling.Match(n.PrevSibling)
+func (s *NextSiblingSelector) MatchWith(c *MatchContext, n *html.Node) bool {
+	return matchWith(c, s.Selector, n) && isElementNode(n.PrevSibling) && matchWith(c, s.Sibling, n.PrevSibling)
 }
 
 func (s *UniversalSelector) String() string { return "*" }
@@ -188,6 +447,9 @@ func (s *PseudoSelector) String() string    { return ":" + EscapeIdentifier(s.Na
 func (s *PseudoFunctionSelector) String() string {
 	return fmt.Sprintf(":%s(%s)", EscapeIdentifier(s.Name), s.Args)
 }
+func (s *PseudoElementSelector) String() string {
+	return fmt.Sprintf("%s::%s(%s)", s.Selector, EscapeIdentifier(s.Name), s.Args)
+}
 func (s *ElementSelector) String() string     { return s.Element }
 func (s *UnionSelector) String() string       { return fmt.Sprintf("%s, %s", s.SelectorA, s.SelectorB) }
 func (s *DescendantSelector) String() string  { return fmt.Sprintf("%s %s", s.Ancestor, s.Selector) }
@@ -197,6 +459,28 @@ func (s *SubsequentSiblingSelector) String() string {
 	return fmt.Sprintf("%s ~ %s", s.Sibling, s.Selector)
 }
 
+func (a *SelectorArgument) String() string   { return a.Selector.String() }
+func (a *StringArgument) String() string     { return `"` + EscapeString(a.Value) + `"` }
+func (a *IdentifierArgument) String() string { return strings.Join(a.Identifiers, ", ") }
+func (a *NumberArgument) String() string     { return strconv.FormatFloat(a.Value, 'g', -1, 64) }
+func (a *RelativeSelectorArgument) String() string {
+	out := make([]string, len(a.Selectors))
+	for i, s := range a.Selectors {
+		if out[i] = s.Selector.String(); s.Combinator != " " {
+			out[i] = s.Combinator + " " + out[i]
+		}
+	}
+	return strings.Join(out, ", ")
+}
+func (a *NthArgument) String() string {
+	if a.A == 0 {
+		return strconv.Itoa(a.B)
+	} else if a.B == 0 {
+		return fmt.Sprintf("%dn", a.A)
+	}
+	return fmt.Sprintf("%dn%+d", a.A, a.B)
+}
+
 func (s *AttributeSelector) String() string {
 	if s.Type == "" {
 		return fmt.Sprintf("[%s]", EscapeIdentifier(s.Key))
@@ -0,0 +1,210 @@
+package css
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// SelectorSet matches many selectors against a document in a single traversal.
+// Like in browsers, selectors are hashed by the id, class or element of their rightmost compound selector,
+// so for any given node only the selectors that can possibly match it are evaluated.
+type SelectorSet struct {
+	Selectors []Selector
+	ids       map[string][]rule
+	classes   map[string][]rule
+	elements  map[string][]rule
+	universal []rule
+	// parts contains the rules of ::part branches - the only ones matched in shadow trees by All.
+	parts []rule
+}
+
+type rule struct {
+	index    int
+	selector Selector
+}
+
+func CompileSet(selectors ...string) (*SelectorSet, error) {
+	ss := make([]Selector, len(selectors))
+	for i, selector := range selectors {
+		s, err := Compile(selector)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", selector, err)
+		}
+		ss[i] = s
+	}
+	return NewSelectorSet(ss...), nil
+}
+
+func MustCompileSet(selectors ...string) *SelectorSet {
+	s, err := CompileSet(selectors...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func NewSelectorSet(selectors ...Selector) *SelectorSet {
+	set := &SelectorSet{
+		Selectors: selectors,
+		ids:       map[string][]rule{},
+		classes:   map[string][]rule{},
+		elements:  map[string][]rule{},
+	}
+	for i, s := range selectors {
+		for _, s := range unionBranches(s, nil) {
+			set.add(rule{i, s})
+			if isPart(s) {
+				set.parts = append(set.parts, rule{i, s})
+			}
+		}
+	}
+	return set
+}
+
+// Match returns the sorted indices of all selectors in the set that match n.
+func (set *SelectorSet) Match(n *html.Node) []int {
+	return set.match(nil, n, nil)
+}
+
+// All returns the sorted indices of the matching selectors for every element in the tree rooted at n.
+// Elements not matched by any selector are omitted. Like All, it does not descend into template contents and
+// declarative shadow roots - only ::part matches elements of the latter.
+func (set *SelectorSet) All(n *html.Node) map[*html.Node][]int {
+	m := map[*html.Node][]int{}
+	set.all(&MatchContext{}, n, m, nil)
+	return m
+}
+
+func (set *SelectorSet) all(c *MatchContext, n *html.Node, m map[*html.Node][]int, buf []int) []int {
+	if n.Type == html.ElementNode {
+		if buf = set.match(c, n, buf[:0]); len(buf) != 0 {
+			m[n] = append([]int(nil), buf...)
+		}
+	}
+	if !defaultQuery.descends(n) {
+		return buf
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if defaultQuery.enters(child) {
+			buf = set.all(c, child, m, buf)
+		} else if len(set.parts) != 0 {
+			defaultQuery.visitShadowTree(child, func(n *html.Node) bool {
+				if buf = sortUnique(matchRules(c, set.parts, n, buf[:0])); len(buf) != 0 {
+					m[n] = append([]int(nil), buf...)
+				}
+				return true
+			})
+		}
+	}
+	return buf
+}
+
+func (set *SelectorSet) match(c *MatchContext, n *html.Node, is []int) []int {
+	if !isElementNode(n) {
+		return is
+	}
+	is = matchRules(c, set.universal, n, is)
+	is = matchRules(c, set.elements[n.Data], n, is)
+	for _, a := range n.Attr {
+		if a.Key == "id" {
+			is = matchRules(c, set.ids[a.Val], n, is)
+			break
+		}
+	}
+	for _, a := range n.Attr {
+		if a.Key == "class" {
+			for _, class := range strings.FieldsFunc(a.Val, isWhitespace) {
+				is = matchRules(c, set.classes[class], n, is)
+			}
+			break
+		}
+	}
+	return sortUnique(is)
+}
+
+// sortUnique sorts is and removes duplicates in place.
+func sortUnique(is []int) []int {
+	if len(is) < 2 {
+		return is
+	}
+	sort.Ints(is)
+	j := 1
+	for i := 1; i < len(is); i++ {
+		if is[i] != is[j-1] {
+			is[j] = is[i]
+			j++
+		}
+	}
+	return is[:j]
+}
+
+func (set *SelectorSet) add(r rule) {
+	switch id, class, element := subjectKey(r.selector); {
+	case id != "":
+		set.ids[id] = append(set.ids[id], r)
+	case class != "":
+		set.classes[class] = append(set.classes[class], r)
+	case element != "":
+		set.elements[element] = append(set.elements[element], r)
+	default:
+		set.universal = append(set.universal, r)
+	}
+}
+
+func matchRules(c *MatchContext, rules []rule, n *html.Node, is []int) []int {
+	for _, r := range rules {
+		if matchWith(c, r.selector, n) {
+			is = append(is, r.index)
+		}
+	}
+	return is
+}
+
+// subject returns the rightmost compound selector of s, i.e. the one that has to match the node itself.
+func subject(s Selector) Selector {
+	switch s := s.(type) {
+	case *DescendantSelector:
+		return subject(s.Selector)
+	case *ChildSelector:
+		return subject(s.Selector)
+	case *NextSiblingSelector:
+		return subject(s.Selector)
+	case *SubsequentSiblingSelector:
+		return subject(s.Selector)
+	}
+	return s
+}
+
+// subjectKey returns the first id, class and element required by the subject of s.
+// Any of them may be empty - e.g. for universal or custom selectors.
+func subjectKey(s Selector) (id, class, element string) {
+	sequence, ok := subject(s).(*SelectorSequence)
+	if !ok {
+		return "", "", ""
+	}
+	for _, s := range sequence.Selectors {
+		switch s := s.(type) {
+		case *IDSelector:
+			if id == "" {
+				id = s.Value
+			}
+		case *ClassSelector:
+			if class == "" {
+				class = s.Value
+			}
+		case *ElementSelector:
+			element = s.Element
+		}
+	}
+	return id, class, element
+}
+
+func unionBranches(s Selector, ss []Selector) []Selector {
+	if u, ok := s.(*UnionSelector); ok {
+		return unionBranches(u.SelectorB, unionBranches(u.SelectorA, ss))
+	}
+	return append(ss, s)
+}
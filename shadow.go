@@ -0,0 +1,188 @@
+package css
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Declarative shadow roots are template elements with a shadowrootmode attribute. The html parser keeps them
+// as children of their host - the shadow tree is the content of the template, the other children of the host
+// are its light tree.
+
+// pseudoElement returns the compile function of a supported pseudo-element. It parses the arguments and returns
+// a match function that returns the originating element of n - or nil if n is not matched by the pseudo-element.
+func pseudoElement(name string) func(args string, spans *Spans, offset int) (Argument, func(*MatchContext, *html.Node) *html.Node, error) {
+	switch name {
+	case "slotted":
+		return slotted
+	case "part":
+		return part
+	}
+	return nil
+}
+
+func isShadowRoot(n *html.Node) bool {
+	return isTemplate(n) && hasAttribute(n, "shadowrootmode") && isElementNode(n.Parent)
+}
+
+// shadowRoot returns the declarative shadow root of n - only the first one is attached.
+func shadowRoot(n *html.Node) *html.Node {
+	if n.Type != html.ElementNode {
+		return nil
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if isShadowRoot(c) {
+			return c
+		}
+	}
+	return nil
+}
+
+// shadowHost returns the host of the shadow tree containing n.
+func shadowHost(n *html.Node) *html.Node {
+	for n := n.Parent; n != nil; n = n.Parent {
+		if isShadowRoot(n) {
+			return n.Parent
+		}
+	}
+	return nil
+}
+
+// isScopedHost reports whether n is a shadow host matched from inside its shadow tree, i.e. whether the Scope
+// of c is its shadow root or inside of it - but not inside a nested shadow tree. Like in browsers, :host never
+// matches in queries of the document.
+func isScopedHost(c *MatchContext, n *html.Node) bool {
+	root := shadowRoot(n)
+	if root == nil || c == nil {
+		return false
+	}
+	for s := c.Scope; s != nil; s = s.Parent {
+		if isShadowRoot(s) {
+			return s == root
+		}
+	}
+	return false
+}
+
+func host(argument Argument) (func(*MatchContext, *html.Node) bool, error) {
+	s := argument.(*SelectorArgument).Selector
+	return func(c *MatchContext, n *html.Node) bool { return isScopedHost(c, n) && matchWith(c, s, n) }, nil
+}
+
+// hostContext matches scoped shadow hosts that match the selector themselves or have an ancestor that does.
+// Shadow roots are not part of the ancestors.
+func hostContext(argument Argument) (func(*MatchContext, *html.Node) bool, error) {
+	s := argument.(*SelectorArgument).Selector
+	return func(c *MatchContext, n *html.Node) bool {
+		if !isScopedHost(c, n) {
+			return false
+		}
+		for ; n != nil; n = n.Parent {
+			if n.Type == html.ElementNode && !isShadowRoot(n) && matchWith(c, s, n) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// slotted matches elements of the light tree of a shadow host that are assigned to a slot of its shadow tree.
+// The originating element is that slot.
+func slotted(args string, spans *Spans, offset int) (Argument, func(*MatchContext, *html.Node) *html.Node, error) {
+	argument, err := parseSelectorArgument(args, spans, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := argument.(*SelectorArgument).Selector
+	return argument, func(c *MatchContext, n *html.Node) *html.Node {
+		if n.Type != html.ElementNode || isShadowRoot(n) || n.Parent == nil || !matchWith(c, s, n) {
+			return nil
+		} else if root := shadowRoot(n.Parent); root != nil {
+			return assignedSlot(root, attribute(n, "slot"))
+		}
+		return nil
+	}, nil
+}
+
+// assignedSlot returns the first slot with the given name in the shadow tree of root.
+// Nested shadow trees are separate scopes and not searched.
+func assignedSlot(root *html.Node, name string) *html.Node {
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || isShadowRoot(c) {
+			continue
+		} else if isElement(c, atom.Slot, "slot") && attribute(c, "name") == name {
+			return c
+		} else if slot := assignedSlot(c, name); slot != nil {
+			return slot
+		}
+	}
+	return nil
+}
+
+// part matches elements of a shadow tree that have all of the given part names. The originating element
+// is the shadow host.
+func part(args string, _ *Spans, _ int) (Argument, func(*MatchContext, *html.Node) *html.Node, error) {
+	a := &IdentifierArgument{Identifiers: strings.Fields(args)}
+	for _, identifier := range a.Identifiers {
+		if !isPlainIdentifier(identifier) {
+			return nil, nil, fmt.Errorf("bad part name: %q", identifier)
+		}
+	}
+	if len(a.Identifiers) == 0 {
+		return nil, nil, fmt.Errorf("bad part name: %q", args)
+	}
+	return a, func(_ *MatchContext, n *html.Node) *html.Node {
+		if n.Type != html.ElementNode {
+			return nil
+		}
+		parts := attribute(n, "part")
+		for _, name := range a.Identifiers {
+			if !includeMatch(parts, name) {
+				return nil
+			}
+		}
+		return shadowHost(n)
+	}, nil
+}
+
+// isPart checks whether s is a ::part pseudo-element - the only selector matching elements of shadow trees from
+// outside of them.
+func isPart(s Selector) bool {
+	e, ok := s.(*PseudoElementSelector)
+	return ok && e.Name == "part"
+}
+
+// partBranches returns the union of the ::part branches of s - or nil if there are none.
+func partBranches(s Selector) Selector {
+	switch s := s.(type) {
+	case *UnionSelector:
+		return unionOf(partBranches(s.SelectorA), partBranches(s.SelectorB))
+	case *PseudoElementSelector:
+		if isPart(s) {
+			return s
+		}
+	case *Program:
+		// the vm does not know pseudo-elements - ::part branches are kept as fallbacks
+		var parts Selector
+		for _, s := range s.selectors {
+			if isPart(s) {
+				parts = unionOf(parts, s)
+			}
+		}
+		return parts
+	}
+	return nil
+}
+
+// unionOf returns the union of a and b - either of which may be nil.
+func unionOf(a, b Selector) Selector {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	return &UnionSelector{a, b}
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 var (
@@ -25,25 +26,37 @@ func isEmpty(n *html.Node) bool {
 }
 
 func isInput(n *html.Node) bool {
-	return n.Data == "input" || n.Data == "textarea"
+	return isElement(n, atom.Input, "input") || isElement(n, atom.Textarea, "textarea")
+}
+
+// isElement checks whether n is an element of the given type. Atoms are compared if both are known -
+// string comparison is only needed for custom and unknown elements.
+func isElement(n *html.Node, a atom.Atom, element string) bool {
+	if a != 0 && n.DataAtom != 0 {
+		return n.DataAtom == a
+	}
+	return n.Data == element
+}
+
+func isTemplate(n *html.Node) bool {
+	return isElementNode(n) && isElement(n, atom.Template, "template")
+}
+
+func isMedia(n *html.Node) bool {
+	return isElement(n, atom.Audio, "audio") || isElement(n, atom.Video, "video")
 }
 
 func isRoot(n *html.Node) bool {
 	return n.Parent != nil && n.Parent.Type == html.DocumentNode
 }
 
-func onlyChild(ofType bool) func(*html.Node) bool {
-	return func(n *html.Node) bool {
-		if n.Parent == nil {
-			return true
-		}
-		count := 0
-		for c := n.Parent.FirstChild; c != nil && count <= 1; c = c.NextSibling {
-			if c.Type == html.ElementNode && (!ofType || c.Data == n.Data) {
-				count++
-			}
+func onlyChild(ofType bool) func(*MatchContext, *html.Node) bool {
+	return func(c *MatchContext, n *html.Node) bool {
+		p := c.position(n)
+		if ofType {
+			return p.countOfType == 1
 		}
-		return count == 1
+		return p.count == 1
 	}
 }
 
@@ -69,27 +82,315 @@ func parseNthArgs(args string) (int, int, error) {
 	return 0, 0, fmt.Errorf("bad nth arguments: %q", args)
 }
 
-func nthSibling(next func(*html.Node) *html.Node, ofType bool) func(string) (func(*html.Node) bool, error) {
+func nthSibling(last, ofType bool) func(Argument) (func(*MatchContext, *html.Node) bool, error) {
+	return func(argument Argument) (func(*MatchContext, *html.Node) bool, error) {
+		a := argument.(*NthArgument)
+		return nth(a.A, a.B, last, ofType), nil
+	}
+}
+
+// contextFree adapts a match function of an extension to the signature of PseudoClasses and PseudoFunctions.
+func contextFree(match func(*MatchContext, *html.Node) bool) func(*html.Node) bool {
+	return func(n *html.Node) bool { return match(nil, n) }
+}
+
+// contextFreeFunction adapts a PseudoFunctionExtension to the signature of PseudoFunctions.
+func contextFreeFunction(f PseudoFunctionExtension) func(string) (func(*html.Node) bool, error) {
 	return func(args string) (func(*html.Node) bool, error) {
-		a, b, err := parseNthArgs(args)
-		return func(n *html.Node) bool {
-			nth := 1
-			for s := next(n); s != nil; s = next(s) {
-				if s.Type == html.ElementNode && (!ofType || s.Data == n.Data) {
-					nth++
-				}
+		argument, err := parseArgument(f.Argument, args, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		match, err := f.Compile(argument)
+		if err != nil {
+			return nil, err
+		}
+		return contextFree(match), nil
+	}
+}
+
+func not(argument Argument) (func(*MatchContext, *html.Node) bool, error) {
+	s := argument.(*SelectorArgument).Selector
+	return func(c *MatchContext, n *html.Node) bool { return isElementNode(n) && !matchWith(c, s, n) }, nil
+}
+
+func parseArgument(kind ArgumentKind, args string, spans *Spans, offset int) (Argument, error) {
+	switch kind {
+	case SelectorListKind:
+		return parseSelectorArgument(args, spans, offset)
+	case RelativeSelectorListKind:
+		return parseRelativeSelectorArgument(args, spans, offset)
+	case NthKind:
+		return parseNthArgument(args)
+	case StringKind:
+		return parseStringArgument(args)
+	case NumberKind:
+		return parseNumberArgument(args)
+	case IdentifierKind:
+		return parseIdentifierArgument(args)
+	default:
+		return nil, fmt.Errorf("invalid argument kind: %d", kind)
+	}
+}
+
+func parseSelectorArgument(args string, spans *Spans, offset int) (Argument, error) {
+	s, err := compile(args, spans, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &SelectorArgument{s}, nil
+}
+
+// parseRelativeSelectorArgument parses each selector of a comma separated list on its own
+// as the leading combinator is not supported by Compile.
+func parseRelativeSelectorArgument(args string, spans *Spans, offset int) (Argument, error) {
+	a := &RelativeSelectorArgument{}
+	for _, s := range splitSelectorList(args) {
+		r, start := RelativeSelector{Combinator: " "}, offset
+		offset += len(s) + 1 // the selectors are separated by a comma
+		if trimmed := strings.TrimSpace(s); trimmed != "" && strings.ContainsRune(">+~", rune(trimmed[0])) {
+			i := strings.IndexByte(s, trimmed[0])
+			r.Combinator, s, start = s[i:i+1], s[i+1:], start+i+1
+		}
+		compiled, err := compile(s, spans, start)
+		if err != nil {
+			return nil, err
+		}
+		r.Selector = compiled
+		a.Selectors = append(a.Selectors, r)
+	}
+	return a, nil
+}
+
+// splitSelectorList splits s at the commas outside of parentheses, brackets and strings.
+func splitSelectorList(s string) (out []string) {
+	start, depth, quote := 0, 0, byte(0)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			out, start = append(out, s[start:i]), i+1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// Match reports whether any of the relative selectors of a matches relative to n - i.e. like :has(...).
+func (a *RelativeSelectorArgument) Match(c *MatchContext, n *html.Node) bool {
+	for _, r := range a.Selectors {
+		q := query{selector: anchor(r.Selector, Combinators[r.Combinator], anchorSelector{n}), context: c}
+		q.shadow, q.templates = c != nil && c.PierceShadowRoots, c != nil && c.TemplateContents
+		start := n.FirstChild
+		if r.Combinator == "+" || r.Combinator == "~" {
+			start = n.NextSibling
+		}
+		for m := start; m != nil; m = m.NextSibling {
+			if q.first(m, bloomFilter{}) != nil {
+				return true
 			}
-			return isNth(a, b, nth)
-		}, err
+		}
+	}
+	return false
+}
+
+// anchorSelector matches only the node a relative selector is anchored at.
+type anchorSelector struct{ n *html.Node }
+
+func (s anchorSelector) Match(n *html.Node) bool { return n == s.n }
+func (s anchorSelector) String() string          { return ":scope" }
+
+// anchor joins the leftmost compound of s to the anchor via the given combinator.
+func anchor(s Selector, combine func(Selector, Selector) Selector, a Selector) Selector {
+	switch s := s.(type) {
+	case *DescendantSelector:
+		return &DescendantSelector{Ancestor: anchor(s.Ancestor, combine, a), Selector: s.Selector}
+	case *ChildSelector:
+		return &ChildSelector{Parent: anchor(s.Parent, combine, a), Selector: s.Selector}
+	case *NextSiblingSelector:
+		return &NextSiblingSelector{Sibling: anchor(s.Sibling, combine, a), Selector: s.Selector}
+	case *SubsequentSiblingSelector:
+		return &SubsequentSiblingSelector{Sibling: anchor(s.Sibling, combine, a), Selector: s.Selector}
+	}
+	return combine(a, s)
+}
+
+func parseNumberArgument(args string) (Argument, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(args), 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad number argument: %q", args)
 	}
+	return &NumberArgument{f}, nil
 }
 
-func nthSiblingCompiled(next func(*html.Node) *html.Node, args string, ofType bool) func(*html.Node) bool {
-	f, err := nthSibling(next, ofType)(args)
+func parseNthArgument(args string) (Argument, error) {
+	a, b, err := parseNthArgs(args)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return &NthArgument{a, b}, nil
+}
+
+func parseStringArgument(args string) (Argument, error) {
+	if s := strings.TrimSpace(args); len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		args = s[1 : len(s)-1]
+	}
+	return &StringArgument{Unescape(args)}, nil
+}
+
+func parseIdentifierArgument(args string) (Argument, error) {
+	a := &IdentifierArgument{}
+	for _, identifier := range strings.Split(args, ",") {
+		if identifier = strings.TrimSpace(identifier); !isPlainIdentifier(identifier) || identifier == "" {
+			return nil, fmt.Errorf("bad identifier argument: %q", identifier)
+		}
+		a.Identifiers = append(a.Identifiers, identifier)
+	}
+	return a, nil
+}
+
+// lang matches elements whose language - i.e. the lang attribute of the element or of its nearest ancestor that
+// has one - equals one of the identifiers or starts with one of them followed by "-". Matching is case-insensitive.
+func lang(argument Argument) (func(*MatchContext, *html.Node) bool, error) {
+	identifiers := argument.(*IdentifierArgument).Identifiers
+	return func(c *MatchContext, n *html.Node) bool {
+		if !isElementNode(n) {
+			return false
+		}
+		for ; n != nil; n = n.Parent {
+			if !hasAttribute(n, "lang") {
+				continue
+			}
+			value := strings.ToLower(attribute(n, "lang"))
+			for _, identifier := range identifiers {
+				if identifier = strings.ToLower(identifier); value == identifier || strings.HasPrefix(value, identifier+"-") {
+					return true
+				}
+			}
+			return false
+		}
+		return false
+	}, nil
+}
+
+func nth(a, b int, last, ofType bool) func(*MatchContext, *html.Node) bool {
+	return func(c *MatchContext, n *html.Node) bool {
+		return isNth(a, b, c.position(n).nth(last, ofType))
+	}
+}
+
+// position is the 1-based position of an element among its sibling elements.
+type position struct {
+	index, count             int
+	indexOfType, countOfType int
+}
+
+func (p position) nth(last, ofType bool) int {
+	switch {
+	case last && ofType:
+		return p.countOfType - p.indexOfType + 1
+	case last:
+		return p.count - p.index + 1
+	case ofType:
+		return p.indexOfType
+	default:
+		return p.index
+	}
+}
+
+// position returns the position of n among its siblings.
+// Positions are computed for all children of the parent of n at once and cached for the rest of the traversal.
+func (c *MatchContext) position(n *html.Node) position {
+	if c == nil || n.Parent == nil {
+		return siblingPosition(n)
+	} else if c.index != nil {
+		if p, ok := c.index.positions[n]; ok {
+			return p
+		}
+	}
+	p, ok := c.positions[n]
+	if !ok {
+		if c.types == nil {
+			c.types = map[elementType]int{}
+		}
+		c.positions = childPositions(n.Parent, c.positions, c.types)
+		p = c.positions[n]
+	}
+	return p
+}
+
+func siblingPosition(n *html.Node) position {
+	p := position{1, 1, 1, 1}
+	for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode {
+			p.index, p.count = p.index+1, p.count+1
+			if isElement(s, n.DataAtom, n.Data) {
+				p.indexOfType, p.countOfType = p.indexOfType+1, p.countOfType+1
+			}
+		}
+	}
+	for s := n.NextSibling; s != nil; s = s.NextSibling {
+		if s.Type == html.ElementNode {
+			p.count++
+			if isElement(s, n.DataAtom, n.Data) {
+				p.countOfType++
+			}
+		}
 	}
-	return f
+	return p
+}
+
+// elementType identifies the type of an element - by its atom, or by its name for custom and unknown elements.
+type elementType struct {
+	atom atom.Atom
+	name string
+}
+
+func typeOf(n *html.Node) elementType {
+	if n.DataAtom != 0 {
+		return elementType{atom: n.DataAtom}
+	}
+	return elementType{name: n.Data}
+}
+
+// childPositions adds the positions of the children of n to ps. countOfType is used to count the children of
+// each type - it is cleared first so that its storage can be reused.
+func childPositions(n *html.Node, ps map[*html.Node]position, countOfType map[elementType]int) map[*html.Node]position {
+	if ps == nil {
+		ps = map[*html.Node]position{}
+	}
+	if countOfType == nil {
+		countOfType = map[elementType]int{}
+	}
+	for t := range countOfType {
+		delete(countOfType, t)
+	}
+	count := 0
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			t := typeOf(c)
+			count, countOfType[t] = count+1, countOfType[t]+1
+			ps[c] = position{index: count, indexOfType: countOfType[t]}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			p := ps[c]
+			p.count, p.countOfType = count, countOfType[typeOf(c)]
+			ps[c] = p
+		}
+	}
+	return ps
 }
 
 func atoi(s, fallback string) (int, error) {
@@ -118,11 +419,25 @@ func hasAttribute(n *html.Node, key string) bool {
 	return false
 }
 
+// attribute returns the value of the attribute key of n - or "" if n does not have it.
+func attribute(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func elementSelector(element string) *ElementSelector {
+	return &ElementSelector{Element: element, atom: atom.Lookup([]byte(element))}
+}
+
 func attributeSelector(key, value, kind string) *AttributeSelector {
 	if Matchers[kind] == nil {
 		panic("invalid match type for attribute selector: " + kind)
 	}
-	return &AttributeSelector{key, value, kind, Matchers[kind]}
+	return &AttributeSelector{Key: key, Value: value, Type: kind, match: Matchers[kind]}
 }
 
 func includeMatch(value, sValue string) bool {
@@ -137,18 +452,123 @@ func includeMatch(value, sValue string) bool {
 	}
 }
 
-func contains(substring string) (func(*html.Node) bool, error) {
-	if substring != "" && substring[0] == '"' && substring[len(substring)-1] == '"' {
-		substring = substring[1 : len(substring)-1]
+func contains(argument Argument) (func(*MatchContext, *html.Node) bool, error) {
+	substring := argument.(*StringArgument).Value
+	return func(c *MatchContext, n *html.Node) bool { return strings.Contains(c.Text(n), substring) }, nil
+}
+
+type span struct{ start, end int }
+
+// Text returns the text content of n, i.e. the data of all text nodes inside it.
+// The text content of the whole tree of n is computed at once and cached for the rest of the traversal -
+// the text of each element is a substring of it.
+func (c *MatchContext) Text(n *html.Node) string {
+	if c == nil {
+		b := &strings.Builder{}
+		writeText(b, n, nil, false, nil)
+		return b.String()
 	}
-	return func(n *html.Node) bool {
-		var s strings.Builder
-		err := html.Render(&s, n)
-		if err != nil {
-			panic(err)
+	s, ok := c.texts[n]
+	if !ok && n.Type == html.ElementNode {
+		if root := rootOf(n); root != c.textRoot {
+			c.cacheTexts(root)
+			s, ok = c.texts[n]
 		}
-		return strings.Contains(s.String(), substring)
-	}, nil
+	}
+	if ok {
+		return c.content[s.start:s.end]
+	}
+	return (*MatchContext)(nil).Text(n)
+}
+
+// cacheTexts computes the text content of the tree of root. Template contents and shadow trees are not part
+// of the text content of their ancestors - their text content is appended afterwards, so that the text of the
+// elements inside them is cached as well (e.g. for AllInTemplate or PierceShadowRoots).
+func (c *MatchContext) cacheTexts(root *html.Node) {
+	b, skipped := &strings.Builder{}, []*html.Node{}
+	c.texts, c.textRoot = map[*html.Node]span{}, root
+	writeText(b, root, c.texts, c.TemplateContents, &skipped)
+	for i := 0; i < len(skipped); i++ {
+		for n := skipped[i].FirstChild; n != nil; n = n.NextSibling {
+			writeText(b, n, c.texts, c.TemplateContents, &skipped)
+		}
+	}
+	c.content = b.String()
+}
+
+// writeText writes the text content of n. Like in browsers, template contents are not part of it - unless
+// templates is set. Shadow trees never are. The templates and shadow roots whose children are not written
+// are appended to skipped.
+func writeText(b *strings.Builder, n *html.Node, texts map[*html.Node]span, templates bool, skipped *[]*html.Node) {
+	start := b.Len()
+	if n.Type == html.TextNode {
+		b.WriteString(n.Data)
+	}
+	if !isTemplate(n) || templates && !isShadowRoot(n) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writeText(b, c, texts, templates, skipped)
+		}
+	} else if skipped != nil {
+		*skipped = append(*skipped, n)
+	}
+	if texts != nil && n.Type == html.ElementNode {
+		texts[n] = span{start, b.Len()}
+	}
+}
+
+func rootOf(n *html.Node) *html.Node {
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	return n
+}
+
+// is reports whether n is in the given state - without an ElementState no element is in any state.
+func (c *MatchContext) is(n *html.Node, state State) bool {
+	return c != nil && c.State != nil && c.State.Is(n, state)
+}
+
+func hasState(state State) func(*MatchContext, *html.Node) bool {
+	return func(c *MatchContext, n *html.Node) bool { return c.is(n, state) }
+}
+
+// focusWithin matches elements that are focused or have a focused descendant. The elements are collected by
+// walking up from the focused elements of the tree of n - again whenever n belongs to another tree.
+func focusWithin(c *MatchContext, n *html.Node) bool {
+	if c == nil || c.State == nil {
+		return false
+	} else if root := rootOf(n); root != c.focusRoot {
+		c.focused, c.focusRoot = map[*html.Node]bool{}, root
+		addFocused(c, root)
+	}
+	return c.focused[n]
+}
+
+func addFocused(c *MatchContext, n *html.Node) {
+	if n.Type == html.ElementNode && c.is(n, Focus) {
+		for m := n; m != nil && !c.focused[m]; m = m.Parent {
+			c.focused[m] = true
+		}
+	}
+	for n := n.FirstChild; n != nil; n = n.NextSibling {
+		addFocused(c, n)
+	}
+}
+
+// reset clears the caches of c - keeping the storage of the positions for the next traversal.
+func (c *MatchContext) reset() {
+	for n := range c.positions {
+		delete(c.positions, n)
+	}
+	c.content, c.texts, c.textRoot, c.focused, c.focusRoot = "", nil, nil, nil, nil
+}
+
+// parent returns the parent of n - or nil if that is the scope of the traversal.
+func (c *MatchContext) parent(n *html.Node) *html.Node {
+	if c != nil && c.Scope != nil && n.Parent == c.Scope {
+		return nil
+	}
+	return n.Parent
 }
 
 func isElementNode(n *html.Node) bool {